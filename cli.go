@@ -1,27 +1,225 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/pkg/errors"
+	"github.com/sean-/circonus-reaper/reaper"
 )
 
+// Commands.  reap, report and daemon take the name of a reaper.
+const (
+	commandDaemon         = "daemon"
+	commandReap           = "reap"
+	commandReport         = "report"
+	commandRestore        = "restore"
+	commandValidateConfig = "validate-config"
+
+	// commandReapTarget is the original spelling of reap target and is kept
+	// as an alias of it.
+	commandReapTarget = "reap-target"
+)
+
+// reaperTarget reaps the targets given on the command line or on stdin
+// instead of the targets missing from Consul.
+const reaperTarget = "target"
+
+// reaperCommand is a reaper that can be run by reap, report and daemon.
+type reaperCommand struct {
+	name    string
+	mode    string
+	summary string
+	help    string // printed after the summary in the reaper's usage
+	flags   func(f *cliFlags, fs *flag.FlagSet)
+}
+
+var reaperCommands = []reaperCommand{
+	{
+		name:    "hosts",
+		mode:    reaper.ModeHosts,
+		summary: "Deactivate the check bundles of targets no longer in Consul and re-activate those that came back",
+		help: "Targets missing from Consul are only reported unless -deactivate-hosts is set,\n" +
+			"since that covers every Circonus target Consul doesn't know about, including\n" +
+			"targets Consul never managed.  Run \"report hosts\" first to see which.  Check\n" +
+			"bundles are disabled and tagged so they can be re-activated.",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			f.consulFlags(fs)
+			fs.BoolVar(&f.deactivateHosts, "deactivate-hosts", f.deactivateHosts, "Deactivate the check bundles of Circonus targets missing from Consul instead of only reporting them")
+			fs.BoolVar(&f.reactivateHosts, "reactivate-hosts", f.reactivateHosts, "Re-activate check bundles deactivated by the reaper when their target is back in Consul")
+		},
+	},
+	{
+		name:    "allocs",
+		mode:    reaper.ModeAllocs,
+		summary: "Deactivate the metrics of finished Nomad allocs",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			f.nomadFlags(fs)
+		},
+	},
+	{
+		name:    "query",
+		mode:    reaper.ModeQuery,
+		summary: "Act on the metrics matching Circonus search queries",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			f.queryFlags(fs, "Circonus search query of metrics to act on (may be set more than once)")
+			fs.StringVar(&f.queryAction, "query-action", f.queryAction, `Action to take on metrics matching -query ("deactivate","activate","add-tag","remove-tag","set-units")`)
+			fs.StringVar(&f.queryTag, "query-tag", f.queryTag, "Metric tag to add or remove with -query-action=add-tag or remove-tag")
+			fs.StringVar(&f.queryUnits, "query-units", f.queryUnits, "Metric units to set with -query-action=set-units")
+		},
+	},
+	{
+		name:    "stale",
+		mode:    reaper.ModeStale,
+		summary: "Deactivate active metrics that stopped receiving data",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			f.queryFlags(fs, "Circonus search query to limit the metrics checked for staleness to (may be set more than once)")
+			f.staleFlags(fs)
+		},
+	},
+	{
+		name:    "budget",
+		mode:    reaper.ModeBudget,
+		summary: "Shed metrics until the account is under its metric budget",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			fs.StringVar(&f.budgetRulesArg, "budget-rules", f.budgetRulesArg, `Comma separated order in which to shed metrics when over budget ("stale","nomad","tags")`)
+			fs.Var(&f.budgetTagArg, "budget-tag", "Low-priority tag whose metrics may be shed when over budget (may be set more than once)")
+			fs.StringVar(&f.budgetUsageType, "budget-usage-type", f.budgetUsageType, "Account usage type to compare with the metric budget")
+			fs.UintVar(&f.metricBudget, "metric-budget", f.metricBudget, "Number of active metrics to stay under (default the account limit)")
+			f.nomadFlags(fs)
+			f.staleFlags(fs)
+		},
+	},
+	{
+		name:    "clusters",
+		mode:    reaper.ModeClusters,
+		summary: "Reap metric clusters that match no active metrics",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			fs.UintVar(&f.clusterEmptyRuns, "cluster-empty-runs", f.clusterEmptyRuns, "Consecutive runs a metric cluster must match no active metrics before it is reaped")
+			fs.StringVar(&f.clusterPolicy, "cluster-policy", f.clusterPolicy, `What to do with metric clusters matching no active metrics ("report","delete")`)
+			f.consulFlags(fs)
+			fs.StringVar(&f.stateConsulKey, "state-consul-key", f.stateConsulKey, "Consul KV key to keep state between runs in")
+			fs.StringVar(&f.stateFile, "state-file", f.stateFile, "File to keep state between runs in")
+		},
+	},
+	{
+		name:    "brokers",
+		mode:    reaper.ModeBrokers,
+		summary: "Reap check bundles whose brokers are all gone or inactive",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			fs.StringVar(&f.brokerPolicy, "broker-policy", f.brokerPolicy, `What to do with check bundles whose brokers are all gone or inactive ("report","reassign","deactivate")`)
+			fs.StringVar(&f.replacementBroker, "replacement-broker", f.replacementBroker, "Broker CID to reassign check bundles to with -broker-policy=reassign")
+		},
+	},
+	{
+		name:    "audit",
+		mode:    reaper.ModeAudit,
+		summary: "Find graphs whose datapoints reference inactive metrics",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			fs.BoolVar(&f.auditRemoveDatapoints, "audit-remove-datapoints", f.auditRemoveDatapoints, "Remove datapoints referencing inactive metrics from graphs")
+		},
+	},
+	{
+		name:    reaperTarget,
+		summary: "Reap the targets given as arguments, or one per line on stdin, right away",
+		flags: func(f *cliFlags, fs *flag.FlagSet) {
+			fs.StringVar(&f.targetAction, "target-action", f.targetAction, `What to do with the check bundles of the targets ("deactivate","delete")`)
+		},
+	},
+}
+
+// findReaperCommand returns the reaper named by names.  hosts and allocs may
+// be named together to reap both in a single run.
+func findReaperCommand(names []string) (*reaperCommand, error) {
+	if len(names) == 2 && containsString(names, "hosts") && containsString(names, "allocs") {
+		hosts, _ := findReaperCommand([]string{"hosts"})
+		allocs, _ := findReaperCommand([]string{"allocs"})
+		return &reaperCommand{
+			name: "hosts allocs",
+			mode: reaper.ModeConsulNomad,
+			flags: func(f *cliFlags, fs *flag.FlagSet) {
+				hosts.flags(f, fs)
+				allocs.flags(f, fs)
+			},
+		}, nil
+	}
+
+	if len(names) != 1 {
+		return nil, errors.Errorf("only hosts and allocs can be reaped together: %q", strings.Join(names, " "))
+	}
+
+	for i := range reaperCommands {
+		if reaperCommands[i].name == names[0] {
+			return &reaperCommands[i], nil
+		}
+	}
+
+	return nil, errors.Errorf("unknown reaper: %q", names[0])
+}
+
 type cliConfig struct {
-	circonusAPIKey  *string
-	circonusAppName *string
-	circonusAPIURL  *string
-	consulAddr      *string
-	dryRun          bool
-	excludedTargets []string
-	excludeRegexps  []*regexp.Regexp
-	nomadAddr       *string
-	mode            string
-	metricQuery     string
+	command               string
+	reaper                string
+	validateOnly          bool
+	targets               []string
+	targetAction          string
+	auditRemoveDatapoints bool
+	annotate              bool
+	annotatePerTarget     bool
+	annotationCategory    string
+	brokerPolicy          string
+	cacheDir              string
+	budgetRules           []string
+	budgetTags            []string
+	budgetUsageType       string
+	clusterEmptyRuns      uint
+	clusterPolicy         string
+	circonusAPIKey        *string
+	circonusAppName       *string
+	circonusAPIURL        *string
+	consulAddr            *string
+	deactivateHosts       bool
+	dryRun                bool
+	excludedTargets       []string
+	excludeRegexps        []*regexp.Regexp
+	nomadAddr             *string
+	nomadDefaultPolicy    reaper.NomadJobPolicy
+	mode                  string
+	metricQueries         []string
+	queryAction           string
+	queryTag              string
+	queryUnits            string
+	reactivateHosts       bool
+	refreshCache          bool
+	reportFile            string
+	reportFormat          string
+	metricsTrapURL        string
+	interval              time.Duration
+	httpAddr              string
+	logLevel              reaper.LogLevel
+	logFormat             string
+	journalFile           string
+	ruleSetPolicy         string
+	maintenanceScope      string
+	maintenanceWindow     time.Duration
+	stateConsulKey        string
+	stateFile             string
+	watch                 bool
+	replacementBroker     string
+	staleAfter            time.Duration
+	staleMaxMetrics       uint
+	metricBudget          uint
+	unknownStatusPolicy   string
+	requestTimeout        time.Duration
+	runTimeout            time.Duration
 }
 
 type stringSliceArg []string
@@ -43,49 +241,434 @@ func (s *stringSliceArg) Set(str string) error {
 	return nil
 }
 
-func parseCLI() (*cliConfig, error) {
-	var circonusAPIKey string
-	flag.StringVar(&circonusAPIKey, "circonus-api-key", "", "Circonus API Key (CIRCONUS_API_KEY)")
+type queryListArg []string
+
+// String prints the list of queries as a comma separated string
+func (q *queryListArg) String() string {
+	return strings.Join(*q, ", ")
+}
+
+// Set adds a query to the queryListArg
+func (q *queryListArg) Set(str string) error {
+	if strings.TrimSpace(str) == "" {
+		return fmt.Errorf("Invalid query: %q", str)
+	}
+
+	*q = append(*q, str)
+
+	return nil
+}
+
+// cliFlags holds the values of the flags a command registers.  Every value
+// starts out at its default so that flags a command doesn't register validate
+// as if they hadn't been given.
+type cliFlags struct {
+	annotate              bool
+	annotatePerTarget     bool
+	annotationCategory    string
+	auditRemoveDatapoints bool
+	brokerPolicy          string
+	budgetRulesArg        string
+	budgetTagArg          stringSliceArg
+	budgetUsageType       string
+	cacheDir              string
+	circonusAPIKey        string
+	circonusAppName       string
+	circonusAPIURL        string
+	clusterEmptyRuns      uint
+	clusterPolicy         string
+	consulAddr            string
+	deactivateHosts       bool
+	dryRun                bool
+	excludeRegexpsArg     stringSliceArg
+	excludeTargetArg      stringSliceArg
+	httpAddr              string
+	interval              time.Duration
+	journalFile           string
+	logFormat             string
+	logLevelArg           string
+	maintenanceScope      string
+	maintenanceWindow     time.Duration
+	metricBudget          uint
+	metricsTrapURL        string
+	nomadAddr             string
+	nomadDefaultPolicyArg string
+	queryAction           string
+	queryArg              queryListArg
+	queryFile             string
+	queryTag              string
+	queryUnits            string
+	reactivateHosts       bool
+	refreshCache          bool
+	replacementBroker     string
+	reportFile            string
+	reportFormat          string
+	requestTimeout        time.Duration
+	ruleSetPolicy         string
+	runTimeout            time.Duration
+	staleAfter            time.Duration
+	staleMaxMetrics       uint
+	stateConsulKey        string
+	stateFile             string
+	targetAction          string
+	unknownStatusPolicy   string
+	watch                 bool
+}
 
-	var circonusAppName string
-	flag.StringVar(&circonusAppName, "circonus-app-name", "reaper", "Name to use as the application name in the Circonus API Token UI")
+func newCLIFlags() *cliFlags {
+	return &cliFlags{
+		annotationCategory:    "reaper",
+		brokerPolicy:          reaper.BrokerPolicyReport,
+		budgetRulesArg:        strings.Join([]string{reaper.BudgetRuleStale, reaper.BudgetRuleNomad, reaper.BudgetRuleTags}, ","),
+		budgetUsageType:       "Metric",
+		circonusAppName:       "reaper",
+		clusterEmptyRuns:      3,
+		clusterPolicy:         reaper.ClusterPolicyReport,
+		consulAddr:            "127.0.0.1:8500",
+		logFormat:             reaper.LogFormatText,
+		logLevelArg:           "info",
+		maintenanceScope:      reaper.MaintenanceScopeCheck,
+		nomadAddr:             "http://127.0.0.1:4646",
+		nomadDefaultPolicyArg: reaper.NomadPolicyImmediate,
+		queryAction:           reaper.QueryActionDeactivate,
+		reactivateHosts:       true,
+		reportFormat:          reportFormatText,
+		requestTimeout:        time.Minute,
+		ruleSetPolicy:         reaper.RuleSetPolicyNone,
+		staleAfter:            7 * 24 * time.Hour,
+		staleMaxMetrics:       5000,
+		targetAction:          reaper.TargetActionDeactivate,
+		unknownStatusPolicy:   reaper.UnknownStatusPolicyReport,
+	}
+}
 
-	var circonusAPIURL string
-	flag.StringVar(&circonusAPIURL, "circonus-url", "", "URL for the Circonus API")
+// runFlags registers the flags shared by every command that talks to
+// Circonus.  -dry-run is left out of commands that never make changes.
+func (f *cliFlags) runFlags(fs *flag.FlagSet, dryRun bool) {
+	fs.BoolVar(&f.annotate, "annotate", f.annotate, "Post a Circonus annotation summarizing each non-dry run")
+	fs.BoolVar(&f.annotatePerTarget, "annotate-targets", f.annotatePerTarget, "Post an additional annotation for every deactivated target (requires -annotate)")
+	fs.StringVar(&f.annotationCategory, "annotation-category", f.annotationCategory, "Category to use for Circonus annotations")
+	fs.StringVar(&f.cacheDir, "cache-dir", f.cacheDir, "Directory to cache check bundles and metric statuses in between runs (default no cache)")
+	fs.StringVar(&f.circonusAPIKey, "circonus-api-key", f.circonusAPIKey, "Circonus API Key (CIRCONUS_API_KEY)")
+	fs.StringVar(&f.circonusAppName, "circonus-app-name", f.circonusAppName, "Name to use as the application name in the Circonus API Token UI")
+	fs.StringVar(&f.circonusAPIURL, "circonus-url", f.circonusAPIURL, "URL for the Circonus API")
+	if dryRun {
+		fs.BoolVar(&f.dryRun, "dry-run", f.dryRun, "Do not make any actual changes")
+	}
+	fs.Var(&f.excludeRegexpsArg, "exclude-regexp", "Regexp for a targets to exclude (may be set more than once)")
+	fs.Var(&f.excludeTargetArg, "exclude-target", "Targets to exclude (may be set more than once)")
+	fs.StringVar(&f.journalFile, "journal-file", f.journalFile, "File to append the full JSON of every object to before it is modified or deleted")
+	fs.StringVar(&f.logFormat, "log-format", f.logFormat, `Format of log output ("text","json")`)
+	fs.StringVar(&f.logLevelArg, "log-level", f.logLevelArg, `Minimum level to log ("trace","debug","info","warn","error")`)
+	fs.StringVar(&f.maintenanceScope, "maintenance-scope", f.maintenanceScope, `Scope of the maintenance windows created while reaping ("check","host")`)
+	fs.DurationVar(&f.maintenanceWindow, "maintenance-window", f.maintenanceWindow, "Length of the maintenance window to create around each change (default no maintenance windows)")
+	fs.StringVar(&f.metricsTrapURL, "metrics-trap-url", f.metricsTrapURL, "Circonus HTTPTrap submission URL to report reaper metrics to (CIRCONUS_REAPER_TRAP_URL)")
+	fs.BoolVar(&f.refreshCache, "refresh-cache", f.refreshCache, "Rebuild the check bundle cache from scratch instead of syncing it incrementally")
+	fs.StringVar(&f.reportFile, "report-file", f.reportFile, "File to write the run report to (default stdout)")
+	fs.StringVar(&f.reportFormat, "report-format", f.reportFormat, `Format of the run report ("text","json")`)
+	fs.DurationVar(&f.requestTimeout, "request-timeout", f.requestTimeout, "Abandon any single Circonus, Consul or Nomad request, other than a Circonus update, that takes longer than this (0 to disable)")
+	fs.DurationVar(&f.runTimeout, "run-timeout", f.runTimeout, "Stop starting new requests once a run has taken this long (default no limit)")
+}
 
-	var consulAddr string
-	flag.StringVar(&consulAddr, "consul-addr", "127.0.0.1:8500", "Consul Agent Address")
+// reapFlags registers the flags shared by every reaper.
+func (f *cliFlags) reapFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.ruleSetPolicy, "rule-set-policy", f.ruleSetPolicy, `What to do with rule sets referencing deactivated metrics ("none","report","disable","delete")`)
+	fs.StringVar(&f.unknownStatusPolicy, "unknown-status-policy", f.unknownStatusPolicy, `What to do with metrics whose status is neither active nor available ("skip","report","active")`)
+}
 
-	var excludeRegexpsArg stringSliceArg
-	flag.Var(&excludeRegexpsArg, "exclude-regexp", "Regexp for a targets to exclude (may be set more than once)")
+func (f *cliFlags) consulFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.consulAddr, "consul-addr", f.consulAddr, "Consul Agent Address")
+}
 
-	var excludeTargetArg stringSliceArg
-	flag.Var(&excludeTargetArg, "exclude-target", "Targets to exclude (may be set more than once)")
+func (f *cliFlags) nomadFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.nomadAddr, "nomad-addr", f.nomadAddr, "Nomad Agent Address")
+	fs.StringVar(&f.nomadDefaultPolicyArg, "nomad-default-policy", f.nomadDefaultPolicyArg, `Policy for the metrics of finished allocs of jobs without a circonus_reaper_policy meta key ("keep","immediate","delay:<duration>")`)
+}
 
-	var dryRun bool
-	flag.BoolVar(&dryRun, "dry-run", false, "Do not make any actual changes")
+func (f *cliFlags) queryFlags(fs *flag.FlagSet, usage string) {
+	fs.Var(&f.queryArg, "query", usage)
+	fs.StringVar(&f.queryFile, "query-file", f.queryFile, "File of Circonus search queries, one per line, to use in addition to -query")
+}
 
-	var nomadAddr string
-	flag.StringVar(&nomadAddr, "nomad-addr", "http://127.0.0.1:4646", "Nomad Agent Address")
+func (f *cliFlags) staleFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&f.staleAfter, "stale-after", f.staleAfter, "Deactivate active metrics without any data for this long")
+	fs.UintVar(&f.staleMaxMetrics, "stale-max-metrics", f.staleMaxMetrics, "Maximum number of metrics whose data is fetched per run, picked at random")
+}
+
+func (f *cliFlags) daemonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.httpAddr, "http-addr", f.httpAddr, "Address to serve /metrics and /health on")
+	fs.DurationVar(&f.interval, "interval", f.interval, "Reap once per interval")
+	fs.BoolVar(&f.watch, "watch", f.watch, "Reap as Consul nodes and Nomad allocs change instead of once per -interval (hosts and allocs only)")
+}
 
-	var mode string
-	flag.StringVar(&mode, "mode", "", `Pick a mode to operate in ("query","consul/nomad")`)
+// parseCLI parses the command line, without the program name, into the
+// configuration of a single command.
+func parseCLI(args []string) (*cliConfig, error) {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return nil, errors.Errorf("no command given")
+	}
 
-	var metricQuery string
-	flag.StringVar(&metricQuery, "query", "", "Circonus search query of metrics to disable")
+	command, args := args[0], args[1:]
+	switch command {
+	case commandReap, commandReport, commandDaemon:
+		return parseReaperCommand(command, args, false)
+	case commandReapTarget:
+		return parseReaperCommand(commandReap, append([]string{reaperTarget}, args...), false)
+	case commandRestore:
+		return parseRestoreCommand(args, false)
+	case commandValidateConfig:
+		return parseValidateConfigCommand(args)
+	case "help", "-h", "-help", "--help":
+		printUsage(os.Stdout)
+		os.Exit(0)
+	}
 
-	flag.Parse()
+	printUsage(os.Stderr)
+	return nil, errors.Errorf("unknown command: %q", command)
+}
+
+// parseReaperCommand parses the reaper named at the start of args and its
+// flags for the reap, report or daemon command.
+func parseReaperCommand(command string, args []string, validateOnly bool) (*cliConfig, error) {
+	var names []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		// The arguments after the target reaper are its targets.
+		if len(names) == 1 && names[0] == reaperTarget {
+			break
+		}
+		names, args = append(names, args[0]), args[1:]
+	}
+	if len(names) == 0 {
+		printReaperUsage(os.Stderr, command)
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+			os.Exit(0)
+		}
+		return nil, errors.Errorf("%s requires a reaper", command)
+	}
 
-	if circonusAPIKey == "" {
-		circonusAPIKey = os.Getenv("CIRCONUS_API_KEY")
+	rc, err := findReaperCommand(names)
+	if err != nil {
+		printReaperUsage(os.Stderr, command)
+		return nil, err
 	}
 
-	if circonusAPIURL == "" {
-		circonusAPIURL = os.Getenv("CIRCONUS_API_URL")
+	if command == commandDaemon && rc.name == reaperTarget {
+		return nil, errors.Errorf("%s can not run the %s reaper", command, reaperTarget)
 	}
 
-	excludeRegexps := make([]*regexp.Regexp, 0, len(excludeRegexpsArg))
-	for _, reArg := range excludeRegexpsArg {
+	name := command + " " + rc.name
+	f := newCLIFlags()
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	f.runFlags(fs, command != commandReport)
+	f.reapFlags(fs)
+	rc.flags(f, fs)
+	if command == commandDaemon {
+		f.daemonFlags(fs)
+	}
+
+	var help string
+	switch command {
+	case commandReport:
+		help = fmt.Sprintf("Reports what %q would do without making any changes.", commandReap+" "+rc.name)
+	case commandDaemon:
+		help = fmt.Sprintf("Runs %q once per -interval, or with -watch as Consul and Nomad change,\nuntil interrupted.", commandReap+" "+rc.name)
+	default:
+		help = rc.summary + "."
+	}
+	if rc.help != "" {
+		help += "\n\n" + rc.help
+	}
+
+	usage := name + " [flags]"
+	if rc.name == reaperTarget {
+		usage += " [target...]"
+	}
+	fs.Usage = commandUsage(fs, usage, help)
+	fs.Parse(args)
+
+	cfg, err := f.config(rc.mode)
+	if err != nil {
+		return nil, err
+	}
+	cfg.command = command
+	cfg.reaper = rc.name
+	cfg.validateOnly = validateOnly
+	if command == commandReport {
+		cfg.dryRun = true
+	}
+
+	if command == commandDaemon {
+		switch {
+		case f.watch && f.interval > 0:
+			return nil, errors.Errorf("-watch and -interval are mutually exclusive")
+		case f.watch:
+			switch rc.mode {
+			case reaper.ModeHosts, reaper.ModeAllocs, reaper.ModeConsulNomad:
+			default:
+				return nil, errors.Errorf("-watch can only be used with the hosts and allocs reapers")
+			}
+		case f.interval <= 0:
+			return nil, errors.Errorf("-interval or -watch is required")
+		}
+	}
+
+	if rc.name == reaperTarget {
+		targets, err := readTargetArgs(fs.Args(), !validateOnly)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 0 && !validateOnly {
+			return nil, errors.Errorf("%s requires at least one target", name)
+		}
+		cfg.targets = targets
+
+		switch f.targetAction {
+		case reaper.TargetActionDeactivate:
+		case reaper.TargetActionDelete:
+			if f.journalFile == "" {
+				return nil, errors.Errorf("-journal-file is required with -target-action=%s", f.targetAction)
+			}
+		default:
+			return nil, errors.Errorf("unknown target action: %q", f.targetAction)
+		}
+	} else if fs.NArg() > 0 {
+		return nil, errors.Errorf("unexpected arguments to %s: %q", name, strings.Join(fs.Args(), " "))
+	}
+
+	return cfg, nil
+}
+
+// parseRestoreCommand parses the flags and targets of the restore command.
+func parseRestoreCommand(args []string, validateOnly bool) (*cliConfig, error) {
+	f := newCLIFlags()
+	fs := flag.NewFlagSet(commandRestore, flag.ExitOnError)
+	f.runFlags(fs, true)
+	fs.Usage = commandUsage(fs, commandRestore+" [flags] [target...]",
+		"Re-activates the check bundles the reaper deactivated on the targets given as\n"+
+			"arguments, or one per line on stdin, without checking that they are back in\n"+
+			"Consul.")
+	fs.Parse(args)
+
+	cfg, err := f.config("")
+	if err != nil {
+		return nil, err
+	}
+	cfg.command = commandRestore
+	cfg.validateOnly = validateOnly
+
+	targets, err := readTargetArgs(fs.Args(), !validateOnly)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 && !validateOnly {
+		return nil, errors.Errorf("%s requires at least one target", commandRestore)
+	}
+	cfg.targets = targets
+
+	return cfg, nil
+}
+
+// parseValidateConfigCommand parses the command line of the command to
+// validate.  Targets aren't read from stdin.
+func parseValidateConfigCommand(args []string) (*cliConfig, error) {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		fmt.Fprintf(os.Stderr, "Usage: circonus-reaper %s <command> [args]\n\n", commandValidateConfig)
+		fmt.Fprintln(os.Stderr, "Checks the flags of a command and sets up its Circonus, Consul and Nomad")
+		fmt.Fprintln(os.Stderr, "clients without running it.  Exits non-zero if the command would not start.")
+		if len(args) > 0 {
+			os.Exit(0)
+		}
+		return nil, errors.Errorf("%s requires a command", commandValidateConfig)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case commandReap, commandReport, commandDaemon:
+		return parseReaperCommand(command, args, true)
+	case commandReapTarget:
+		return parseReaperCommand(commandReap, append([]string{reaperTarget}, args...), true)
+	case commandRestore:
+		return parseRestoreCommand(args, true)
+	}
+
+	return nil, errors.Errorf("unknown command to validate: %q", command)
+}
+
+// readTargetArgs returns the targets given as arguments.  Without any, or if
+// the only one is "-", targets are read from stdin if fromStdin is set.
+func readTargetArgs(args []string, fromStdin bool) ([]string, error) {
+	if len(args) == 0 || (len(args) == 1 && args[0] == "-") {
+		if !fromStdin {
+			return nil, nil
+		}
+		return readTargets(os.Stdin)
+	}
+
+	return args, nil
+}
+
+// commandUsage returns the help text of a command: its usage line, what it
+// does and its flags.
+func commandUsage(fs *flag.FlagSet, usage, help string) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: circonus-reaper %s\n\n%s\n\nFlags:\n", usage, help)
+		fs.PrintDefaults()
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: circonus-reaper <command> [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "  %s <reaper>\tReap once and exit\n", commandReap)
+	fmt.Fprintf(tw, "  %s <reaper>\tReport what a reaper would do without making any changes\n", commandReport)
+	fmt.Fprintf(tw, "  %s <reaper>\tReap continuously until interrupted\n", commandDaemon)
+	fmt.Fprintf(tw, "  %s [target...]\tRe-activate the check bundles the reaper deactivated on targets\n", commandRestore)
+	fmt.Fprintf(tw, "  %s <command>\tCheck the flags of a command without running it\n", commandValidateConfig)
+	tw.Flush()
+	fmt.Fprintln(w)
+	printReapers(w)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "circonus-reaper <command> [<reaper>] -h" for the flags of a command.`)
+}
+
+func printReaperUsage(w io.Writer, command string) {
+	fmt.Fprintf(w, "Usage: circonus-reaper %s <reaper> [flags]\n\n", command)
+	printReapers(w)
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Run \"circonus-reaper %s <reaper> -h\" for the flags of a reaper.\n", command)
+}
+
+func printReapers(w io.Writer) {
+	fmt.Fprintln(w, "Reapers:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, rc := range reaperCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", rc.name, rc.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `"hosts allocs" reaps both hosts and allocs in a single run.`)
+}
+
+// config validates the flags and returns the configuration of a command that
+// runs in mode.
+func (f *cliFlags) config(mode string) (*cliConfig, error) {
+	if f.circonusAPIKey == "" {
+		f.circonusAPIKey = os.Getenv("CIRCONUS_API_KEY")
+	}
+
+	if f.circonusAPIURL == "" {
+		f.circonusAPIURL = os.Getenv("CIRCONUS_API_URL")
+	}
+
+	if f.metricsTrapURL == "" {
+		f.metricsTrapURL = os.Getenv("CIRCONUS_REAPER_TRAP_URL")
+	}
+
+	excludeRegexps := make([]*regexp.Regexp, 0, len(f.excludeRegexpsArg))
+	for _, reArg := range f.excludeRegexpsArg {
 		re, err := regexp.Compile(reArg)
 		if err != nil {
 			return nil, errwrap.Wrapf(fmt.Sprintf("unable to compile regexp %q: {{err}}", reArg), err)
@@ -93,22 +676,264 @@ func parseCLI() (*cliConfig, error) {
 		excludeRegexps = append(excludeRegexps, re)
 	}
 
-	switch mode {
-	case "query", "consul/nomad":
+	metricQueries := []string(f.queryArg)
+	if f.queryFile != "" {
+		fileQueries, err := readQueryFile(f.queryFile)
+		if err != nil {
+			return nil, err
+		}
+		metricQueries = append(metricQueries, fileQueries...)
+	}
+
+	if mode == reaper.ModeQuery {
+		if len(metricQueries) == 0 {
+			return nil, errors.Errorf("-query or -query-file is required")
+		}
+
+		switch f.queryAction {
+		case reaper.QueryActionDeactivate, reaper.QueryActionActivate:
+		case reaper.QueryActionAddTag, reaper.QueryActionRemoveTag:
+			if f.queryTag == "" {
+				return nil, errors.Errorf("-query-tag is required with -query-action=%s", f.queryAction)
+			}
+		case reaper.QueryActionSetUnits:
+			if f.queryUnits == "" {
+				return nil, errors.Errorf("-query-units is required with -query-action=%s", f.queryAction)
+			}
+		default:
+			return nil, errors.Errorf("unknown query action: %q", f.queryAction)
+		}
+	}
+
+	if f.refreshCache && f.cacheDir == "" {
+		return nil, errors.Errorf("-refresh-cache requires -cache-dir")
+	}
+
+	if f.stateFile != "" && f.stateConsulKey != "" {
+		return nil, errors.Errorf("-state-file and -state-consul-key are mutually exclusive")
+	}
+
+	if mode == reaper.ModeBrokers {
+		switch f.brokerPolicy {
+		case reaper.BrokerPolicyReport:
+		case reaper.BrokerPolicyReassign, reaper.BrokerPolicyDeactivate:
+			if f.journalFile == "" {
+				return nil, errors.Errorf("-journal-file is required with -broker-policy=%s", f.brokerPolicy)
+			}
+		default:
+			return nil, errors.Errorf("unknown broker policy: %q", f.brokerPolicy)
+		}
+
+		if f.brokerPolicy == reaper.BrokerPolicyReassign && f.replacementBroker == "" {
+			return nil, errors.Errorf("-replacement-broker is required with -broker-policy=%s", f.brokerPolicy)
+		}
+	}
+
+	if mode == reaper.ModeClusters {
+		if f.stateFile == "" && f.stateConsulKey == "" {
+			return nil, errors.Errorf("-state-file or -state-consul-key is required")
+		}
+
+		switch f.clusterPolicy {
+		case reaper.ClusterPolicyReport:
+		case reaper.ClusterPolicyDelete:
+			if f.journalFile == "" {
+				return nil, errors.Errorf("-journal-file is required with -cluster-policy=%s", f.clusterPolicy)
+			}
+		default:
+			return nil, errors.Errorf("unknown cluster policy: %q", f.clusterPolicy)
+		}
+
+		if f.clusterEmptyRuns == 0 {
+			return nil, errors.Errorf("-cluster-empty-runs must be at least 1")
+		}
+	}
+
+	var budgetRules []string
+	for _, rule := range strings.Split(f.budgetRulesArg, ",") {
+		rule = strings.TrimSpace(rule)
+		switch rule {
+		case "":
+			continue
+		case reaper.BudgetRuleStale, reaper.BudgetRuleNomad, reaper.BudgetRuleTags:
+			budgetRules = append(budgetRules, rule)
+		default:
+			return nil, errors.Errorf("unknown budget rule: %q", rule)
+		}
+	}
+
+	if mode == reaper.ModeBudget && containsString(budgetRules, reaper.BudgetRuleTags) && len(f.budgetTagArg) == 0 {
+		return nil, errors.Errorf("-budget-tag is required with the %q budget rule", reaper.BudgetRuleTags)
+	}
+
+	if (mode == reaper.ModeStale || mode == reaper.ModeBudget) && f.staleAfter < time.Hour {
+		return nil, errors.Errorf("-stale-after must be at least 1h")
+	}
+
+	if (mode == reaper.ModeStale || mode == reaper.ModeBudget) && f.staleMaxMetrics == 0 {
+		return nil, errors.Errorf("-stale-max-metrics must be at least 1")
+	}
+
+	nomadDefaultPolicy, err := reaper.ParseNomadJobPolicy(f.nomadDefaultPolicyArg)
+	if err != nil {
+		return nil, errwrap.Wrapf("invalid -nomad-default-policy: {{err}}", err)
+	}
+
+	logLevel, err := reaper.ParseLogLevel(f.logLevelArg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.logFormat {
+	case reaper.LogFormatText, reaper.LogFormatJSON:
+	default:
+		return nil, errors.Errorf("unknown log format: %q", f.logFormat)
+	}
+
+	if f.auditRemoveDatapoints && f.journalFile == "" {
+		return nil, errors.Errorf("-journal-file is required with -audit-remove-datapoints")
+	}
+
+	switch f.maintenanceScope {
+	case reaper.MaintenanceScopeCheck, reaper.MaintenanceScopeHost:
+	default:
+		return nil, errors.Errorf("unknown maintenance scope: %q", f.maintenanceScope)
+	}
+
+	switch f.ruleSetPolicy {
+	case reaper.RuleSetPolicyNone, reaper.RuleSetPolicyReport:
+	case reaper.RuleSetPolicyDisable, reaper.RuleSetPolicyDelete:
+		if f.journalFile == "" {
+			return nil, errors.Errorf("-journal-file is required with -rule-set-policy=%s", f.ruleSetPolicy)
+		}
+	default:
+		return nil, errors.Errorf("unknown rule set policy: %q", f.ruleSetPolicy)
+	}
+
+	if f.requestTimeout < 0 {
+		return nil, errors.Errorf("-request-timeout must not be negative")
+	}
+
+	if f.runTimeout < 0 {
+		return nil, errors.Errorf("-run-timeout must not be negative")
+	}
+
+	switch f.unknownStatusPolicy {
+	case reaper.UnknownStatusPolicySkip, reaper.UnknownStatusPolicyReport, reaper.UnknownStatusPolicyActive:
 	default:
-		return nil, errors.Errorf("unknown mode: %q", mode)
+		return nil, errors.Errorf("invalid unknown status policy: %q", f.unknownStatusPolicy)
+	}
+
+	switch f.reportFormat {
+	case reportFormatText, reportFormatJSON:
+	default:
+		return nil, errors.Errorf("unknown report format: %q", f.reportFormat)
 	}
 
 	return &cliConfig{
-		circonusAPIKey:  &circonusAPIKey,
-		circonusAppName: &circonusAppName,
-		circonusAPIURL:  &circonusAPIURL,
-		consulAddr:      &consulAddr,
-		dryRun:          dryRun,
-		excludeRegexps:  excludeRegexps,
-		excludedTargets: excludeTargetArg,
-		nomadAddr:       &nomadAddr,
-		mode:            mode,
-		metricQuery:     metricQuery,
+		targetAction:          f.targetAction,
+		auditRemoveDatapoints: f.auditRemoveDatapoints,
+		brokerPolicy:          f.brokerPolicy,
+		cacheDir:              f.cacheDir,
+		budgetRules:           budgetRules,
+		budgetTags:            f.budgetTagArg,
+		budgetUsageType:       f.budgetUsageType,
+		clusterEmptyRuns:      f.clusterEmptyRuns,
+		clusterPolicy:         f.clusterPolicy,
+		annotate:              f.annotate,
+		annotatePerTarget:     f.annotatePerTarget,
+		annotationCategory:    f.annotationCategory,
+		circonusAPIKey:        &f.circonusAPIKey,
+		circonusAppName:       &f.circonusAppName,
+		circonusAPIURL:        &f.circonusAPIURL,
+		consulAddr:            &f.consulAddr,
+		deactivateHosts:       f.deactivateHosts,
+		dryRun:                f.dryRun,
+		excludeRegexps:        excludeRegexps,
+		excludedTargets:       f.excludeTargetArg,
+		nomadAddr:             &f.nomadAddr,
+		nomadDefaultPolicy:    nomadDefaultPolicy,
+		mode:                  mode,
+		metricQueries:         metricQueries,
+		queryAction:           f.queryAction,
+		queryTag:              f.queryTag,
+		queryUnits:            f.queryUnits,
+		reactivateHosts:       f.reactivateHosts,
+		refreshCache:          f.refreshCache,
+		reportFile:            f.reportFile,
+		reportFormat:          f.reportFormat,
+		metricsTrapURL:        f.metricsTrapURL,
+		interval:              f.interval,
+		httpAddr:              f.httpAddr,
+		logLevel:              logLevel,
+		logFormat:             f.logFormat,
+		journalFile:           f.journalFile,
+		ruleSetPolicy:         f.ruleSetPolicy,
+		maintenanceScope:      f.maintenanceScope,
+		maintenanceWindow:     f.maintenanceWindow,
+		stateConsulKey:        f.stateConsulKey,
+		stateFile:             f.stateFile,
+		watch:                 f.watch,
+		replacementBroker:     f.replacementBroker,
+		staleAfter:            f.staleAfter,
+		staleMaxMetrics:       f.staleMaxMetrics,
+		metricBudget:          f.metricBudget,
+		unknownStatusPolicy:   f.unknownStatusPolicy,
+		requestTimeout:        f.requestTimeout,
+		runTimeout:            f.runTimeout,
 	}, nil
 }
+
+// readQueryFile returns the queries in path, one per line.  Blank lines and
+// lines starting with # are ignored.
+func readQueryFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to open query file %q: {{err}}", path), err)
+	}
+	defer f.Close()
+
+	var queries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		queries = append(queries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to read query file %q: {{err}}", path), err)
+	}
+
+	return queries, nil
+}
+
+// readTargets returns the targets in r, one per line.  Blank lines and lines
+// starting with # are ignored.
+func readTargets(r io.Reader) ([]string, error) {
+	var targets []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errwrap.Wrapf("unable to read targets: {{err}}", err)
+	}
+
+	return targets, nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
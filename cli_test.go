@@ -0,0 +1,306 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sean-/circonus-reaper/reaper"
+)
+
+func TestParseCLI(t *testing.T) {
+	tests := []struct {
+		name                string
+		args                []string
+		wantErr             string
+		wantCommand         string
+		wantReaper          string
+		wantMode            string
+		wantDryRun          bool
+		wantValidateOnly    bool
+		wantDeactivateHosts bool
+		wantTargets         []string
+		wantTargetAction    string
+		wantInterval        time.Duration
+		wantWatch           bool
+	}{
+		{
+			name:             "reap",
+			args:             []string{"reap", "hosts"},
+			wantCommand:      commandReap,
+			wantReaper:       "hosts",
+			wantMode:         reaper.ModeHosts,
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:             "reap dry run",
+			args:             []string{"reap", "allocs", "-dry-run"},
+			wantCommand:      commandReap,
+			wantReaper:       "allocs",
+			wantMode:         reaper.ModeAllocs,
+			wantDryRun:       true,
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:             "reap hosts and allocs",
+			args:             []string{"reap", "hosts", "allocs"},
+			wantCommand:      commandReap,
+			wantReaper:       "hosts allocs",
+			wantMode:         reaper.ModeConsulNomad,
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:                "reap deactivating hosts",
+			args:                []string{"reap", "hosts", "-deactivate-hosts"},
+			wantCommand:         commandReap,
+			wantReaper:          "hosts",
+			wantMode:            reaper.ModeHosts,
+			wantDeactivateHosts: true,
+			wantTargetAction:    reaper.TargetActionDeactivate,
+		},
+		{
+			name:    "reap without a reaper",
+			args:    []string{"reap"},
+			wantErr: "reap requires a reaper",
+		},
+		{
+			name:    "reap unknown reaper",
+			args:    []string{"reap", "bogus"},
+			wantErr: `unknown reaper: "bogus"`,
+		},
+		{
+			name:    "reap reapers that can't be combined",
+			args:    []string{"reap", "hosts", "stale"},
+			wantErr: "only hosts and allocs can be reaped together",
+		},
+		{
+			name:    "reap with unexpected arguments",
+			args:    []string{"reap", "hosts", "-dry-run", "web1"},
+			wantErr: "unexpected arguments to reap hosts",
+		},
+		{
+			name:    "reap query without a query",
+			args:    []string{"reap", "query"},
+			wantErr: "-query or -query-file is required",
+		},
+		{
+			name:    "reap deleting rule sets without a journal",
+			args:    []string{"reap", "hosts", "-rule-set-policy=delete"},
+			wantErr: "-journal-file is required with -rule-set-policy=delete",
+		},
+		{
+			name:             "report",
+			args:             []string{"report", "hosts"},
+			wantCommand:      commandReport,
+			wantReaper:       "hosts",
+			wantMode:         reaper.ModeHosts,
+			wantDryRun:       true,
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:                "report deactivating hosts",
+			args:                []string{"report", "hosts", "allocs", "-deactivate-hosts"},
+			wantCommand:         commandReport,
+			wantReaper:          "hosts allocs",
+			wantMode:            reaper.ModeConsulNomad,
+			wantDryRun:          true,
+			wantDeactivateHosts: true,
+			wantTargetAction:    reaper.TargetActionDeactivate,
+		},
+		{
+			name:             "daemon with an interval",
+			args:             []string{"daemon", "stale", "-interval=1h"},
+			wantCommand:      commandDaemon,
+			wantReaper:       "stale",
+			wantMode:         reaper.ModeStale,
+			wantTargetAction: reaper.TargetActionDeactivate,
+			wantInterval:     time.Hour,
+		},
+		{
+			name:             "daemon watching",
+			args:             []string{"daemon", "hosts", "allocs", "-watch"},
+			wantCommand:      commandDaemon,
+			wantReaper:       "hosts allocs",
+			wantMode:         reaper.ModeConsulNomad,
+			wantTargetAction: reaper.TargetActionDeactivate,
+			wantWatch:        true,
+		},
+		{
+			name:    "daemon without an interval",
+			args:    []string{"daemon", "hosts"},
+			wantErr: "-interval or -watch is required",
+		},
+		{
+			name:    "daemon with an interval and watching",
+			args:    []string{"daemon", "hosts", "-watch", "-interval=1h"},
+			wantErr: "-watch and -interval are mutually exclusive",
+		},
+		{
+			name:    "daemon watching a reaper that can't be watched",
+			args:    []string{"daemon", "stale", "-watch"},
+			wantErr: "-watch can only be used with the hosts and allocs reapers",
+		},
+		{
+			name:    "daemon of the target reaper",
+			args:    []string{"daemon", "target"},
+			wantErr: "daemon can not run the target reaper",
+		},
+		{
+			name:             "reap target",
+			args:             []string{"reap", "target", "web1", "web2"},
+			wantCommand:      commandReap,
+			wantReaper:       reaperTarget,
+			wantTargets:      []string{"web1", "web2"},
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:             "reap target deleting",
+			args:             []string{"reap", "target", "-target-action=delete", "-journal-file=journal.jsonl", "web1"},
+			wantCommand:      commandReap,
+			wantReaper:       reaperTarget,
+			wantTargets:      []string{"web1"},
+			wantTargetAction: reaper.TargetActionDelete,
+		},
+		{
+			name:    "reap target deleting without a journal",
+			args:    []string{"reap", "target", "-target-action=delete", "web1"},
+			wantErr: "-journal-file is required with -target-action=delete",
+		},
+		{
+			name:    "reap target with an unknown action",
+			args:    []string{"reap", "target", "-target-action=bogus", "web1"},
+			wantErr: `unknown target action: "bogus"`,
+		},
+		{
+			name:             "reap-target",
+			args:             []string{"reap-target", "web1"},
+			wantCommand:      commandReap,
+			wantReaper:       reaperTarget,
+			wantTargets:      []string{"web1"},
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:             "reap-target dry run",
+			args:             []string{"reap-target", "-dry-run", "web1"},
+			wantCommand:      commandReap,
+			wantReaper:       reaperTarget,
+			wantDryRun:       true,
+			wantTargets:      []string{"web1"},
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:             "restore",
+			args:             []string{"restore", "-dry-run", "web1", "web2"},
+			wantCommand:      commandRestore,
+			wantDryRun:       true,
+			wantTargets:      []string{"web1", "web2"},
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:                "validate-config reap",
+			args:                []string{"validate-config", "reap", "hosts", "-deactivate-hosts"},
+			wantCommand:         commandReap,
+			wantReaper:          "hosts",
+			wantMode:            reaper.ModeHosts,
+			wantValidateOnly:    true,
+			wantTargetAction:    reaper.TargetActionDeactivate,
+			wantDeactivateHosts: true,
+		},
+		{
+			name:             "validate-config daemon",
+			args:             []string{"validate-config", "daemon", "hosts", "-watch"},
+			wantCommand:      commandDaemon,
+			wantReaper:       "hosts",
+			wantMode:         reaper.ModeHosts,
+			wantValidateOnly: true,
+			wantTargetAction: reaper.TargetActionDeactivate,
+			wantWatch:        true,
+		},
+		{
+			name:    "validate-config daemon without an interval",
+			args:    []string{"validate-config", "daemon", "hosts"},
+			wantErr: "-interval or -watch is required",
+		},
+		{
+			name:             "validate-config reap-target without targets",
+			args:             []string{"validate-config", "reap-target"},
+			wantCommand:      commandReap,
+			wantReaper:       reaperTarget,
+			wantValidateOnly: true,
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:             "validate-config restore without targets",
+			args:             []string{"validate-config", "restore"},
+			wantCommand:      commandRestore,
+			wantValidateOnly: true,
+			wantTargetAction: reaper.TargetActionDeactivate,
+		},
+		{
+			name:    "validate-config without a command",
+			args:    []string{"validate-config"},
+			wantErr: "validate-config requires a command",
+		},
+		{
+			name:    "validate-config unknown command",
+			args:    []string{"validate-config", "bogus"},
+			wantErr: `unknown command to validate: "bogus"`,
+		},
+		{
+			name:    "no command",
+			args:    []string{},
+			wantErr: "no command given",
+		},
+		{
+			name:    "unknown command",
+			args:    []string{"bogus"},
+			wantErr: `unknown command: "bogus"`,
+		},
+	}
+
+	for _, test := range tests {
+		cfg, err := parseCLI(test.args)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: parseCLI(%q) error = %v, want %q", test.name, test.args, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseCLI(%q) = %v", test.name, test.args, err)
+			continue
+		}
+
+		if cfg.command != test.wantCommand {
+			t.Errorf("%s: command = %q, want %q", test.name, cfg.command, test.wantCommand)
+		}
+		if cfg.reaper != test.wantReaper {
+			t.Errorf("%s: reaper = %q, want %q", test.name, cfg.reaper, test.wantReaper)
+		}
+		if cfg.mode != test.wantMode {
+			t.Errorf("%s: mode = %q, want %q", test.name, cfg.mode, test.wantMode)
+		}
+		if cfg.dryRun != test.wantDryRun {
+			t.Errorf("%s: dryRun = %t, want %t", test.name, cfg.dryRun, test.wantDryRun)
+		}
+		if cfg.validateOnly != test.wantValidateOnly {
+			t.Errorf("%s: validateOnly = %t, want %t", test.name, cfg.validateOnly, test.wantValidateOnly)
+		}
+		if cfg.deactivateHosts != test.wantDeactivateHosts {
+			t.Errorf("%s: deactivateHosts = %t, want %t", test.name, cfg.deactivateHosts, test.wantDeactivateHosts)
+		}
+		if !reflect.DeepEqual(cfg.targets, test.wantTargets) {
+			t.Errorf("%s: targets = %q, want %q", test.name, cfg.targets, test.wantTargets)
+		}
+		if cfg.targetAction != test.wantTargetAction {
+			t.Errorf("%s: targetAction = %q, want %q", test.name, cfg.targetAction, test.wantTargetAction)
+		}
+		if cfg.interval != test.wantInterval {
+			t.Errorf("%s: interval = %v, want %v", test.name, cfg.interval, test.wantInterval)
+		}
+		if cfg.watch != test.wantWatch {
+			t.Errorf("%s: watch = %t, want %t", test.name, cfg.watch, test.wantWatch)
+		}
+	}
+}
@@ -1,90 +1,242 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/errwrap"
 	nomadapi "github.com/hashicorp/nomad/api"
+	"github.com/sean-/circonus-reaper/reaper"
+)
+
+// GitCommit is set at build time via -ldflags.
+var GitCommit string
+
+// logger is the process-wide logger.  It is replaced once the CLI has been
+// parsed.
+var logger = reaper.NewLogger(os.Stderr, reaper.LevelInfo, reaper.LogFormatText)
+
+// Process exit codes.  A partial failure means the run completed but some
+// targets or check bundles could not be reaped.
+const (
+	exitClean   = 0
+	exitFatal   = 1
+	exitPartial = 2
+)
+
+const (
+	reportFormatText = "text"
+	reportFormatJSON = "json"
 )
 
 func main() {
-	cliConfig, err := parseCLI()
+	cliConfig, err := parseCLI(os.Args[1:])
 	if err != nil {
-		log.Printf("ERROR: parsing CLI: %v", err)
+		logger.Error("unable to parse CLI", "error", err)
 		os.Exit(1)
 	}
 
-	client, err := setup(cliConfig)
+	logger = reaper.NewLogger(os.Stderr, cliConfig.logLevel, cliConfig.logFormat)
+
+	r, err := setup(cliConfig)
 	if err != nil {
-		log.Printf("ERROR: setting up client: %v", err)
+		logger.Error("unable to set up reaper", "error", err)
 		os.Exit(1)
 	}
 
-	switch client.mode {
-	case "query":
-		if err := client.DeactivateMatchingQuery(); err != nil {
-			log.Printf("ERROR: unable to deactivate metrics matching %q: %v", client.metricQuery, err)
-			os.Exit(1)
-		}
-	case "consul/nomad":
-		if err := client.DeactivateUnknownHosts(); err != nil {
-			log.Printf("ERROR: unable to deactivate unknown hosts: %v", err)
+	if cliConfig.validateOnly {
+		logger.Info("configuration is valid", "command", cliConfig.command, "reaper", cliConfig.reaper)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	if cliConfig.command == commandDaemon {
+		if err := runService(ctx, r, cliConfig); err != nil {
+			logger.Error("unable to run service", "error", err)
 			os.Exit(1)
 		}
+		return
+	}
 
-		if err := client.DeactivateNomadCompletedAllocs(); err != nil {
-			log.Printf("ERROR: unable to deactivate completed nomad allocs: %v", err)
-			os.Exit(1)
+	result, err := runOnce(ctx, r, cliConfig)
+	os.Exit(exitCode(result, err))
+}
+
+// cancelOnSignal cancels the reaper's context on the first SIGINT or SIGTERM.
+// No new updates are started once the context is cancelled, but the one in
+// flight is completed.  A second signal exits immediately.
+func cancelOnSignal(cancel context.CancelFunc) {
+	signalCh := make(chan os.Signal, 2)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signalCh
+	logger.Info("shutting down once in-flight updates complete", "signal", sig.String())
+	cancel()
+
+	sig = <-signalCh
+	logger.Warn("shutting down immediately", "signal", sig.String())
+	os.Exit(exitFatal)
+}
+
+// runOnce performs a single reaping run, or reaps or restores the targets
+// given on the command line, and writes its report.  Errors are logged before
+// being returned.
+func runOnce(ctx context.Context, r *reaper.Reaper, cli *cliConfig) (*reaper.Result, error) {
+	var (
+		result *reaper.Result
+		err    error
+	)
+	switch {
+	case cli.command == commandRestore:
+		result, err = r.RestoreTargets(ctx, cli.targets)
+	case cli.reaper == reaperTarget:
+		result, err = r.ReapTargets(ctx, cli.targets)
+	default:
+		result, err = r.Run(ctx)
+	}
+
+	return result, finishRun(cli, result, err)
+}
+
+// finishRun writes the report of a run.  The run's error is returned unless
+// the report couldn't be written.
+func finishRun(cli *cliConfig, result *reaper.Result, runErr error) error {
+	if err := writeReport(cli, result); err != nil {
+		logger.Error("unable to write report", "error", err)
+		return err
+	}
+
+	return runErr
+}
+
+// writeReport emits the run report in the configured format to the configured
+// destination (stdout if no file was given).
+func writeReport(cli *cliConfig, result *reaper.Result) error {
+	var w io.Writer = os.Stdout
+	if cli.reportFile != "" && cli.reportFile != "-" {
+		f, err := os.Create(cli.reportFile)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to create report file %q: {{err}}", cli.reportFile), err)
 		}
+		defer f.Close()
+		w = f
+	}
 
+	switch cli.reportFormat {
+	case reportFormatJSON:
+		return result.Report.WriteJSON(w)
+	default:
+		result.WriteText(w)
 	}
 
-	client.PrintStats()
+	return nil
 }
 
-func setup(cli *cliConfig) (*client, error) {
-	c := &client{
-		dryRun:         cli.dryRun,
-		excludeRegexps: cli.excludeRegexps,
-		mode:           cli.mode,
-		metricQuery:    cli.metricQuery,
+// exitCode maps the outcome of a run to the process exit status.
+func exitCode(result *reaper.Result, runErr error) int {
+	switch {
+	case runErr != nil:
+		return exitFatal
+	case len(result.Failures) > 0:
+		return exitPartial
+	default:
+		return exitClean
+	}
+}
+
+func setup(cli *cliConfig) (*reaper.Reaper, error) {
+	cfg := &reaper.Config{
+		Mode:                  cli.mode,
+		Logger:                logger,
+		GitCommit:             GitCommit,
+		Annotate:              cli.annotate,
+		AnnotatePerTarget:     cli.annotatePerTarget,
+		AnnotationCategory:    cli.annotationCategory,
+		DryRun:                cli.dryRun,
+		ExcludeRegexps:        cli.excludeRegexps,
+		ExcludeTargets:        cli.excludedTargets,
+		MetricQueries:         cli.metricQueries,
+		QueryAction:           cli.queryAction,
+		QueryTag:              cli.queryTag,
+		QueryUnits:            cli.queryUnits,
+		DeactivateHosts:       cli.deactivateHosts,
+		ReactivateHosts:       cli.reactivateHosts,
+		TargetAction:          cli.targetAction,
+		RuleSetPolicy:         cli.ruleSetPolicy,
+		AuditRemoveDatapoints: cli.auditRemoveDatapoints,
+		ClusterEmptyRuns:      cli.clusterEmptyRuns,
+		ClusterPolicy:         cli.clusterPolicy,
+		BrokerPolicy:          cli.brokerPolicy,
+		ReplacementBroker:     cli.replacementBroker,
+		StaleAfter:            cli.staleAfter,
+		StaleMaxMetrics:       cli.staleMaxMetrics,
+		RequestTimeout:        cli.requestTimeout,
+		RunTimeout:            cli.runTimeout,
+		UnknownStatusPolicy:   cli.unknownStatusPolicy,
+		MetricBudget:          cli.metricBudget,
+		BudgetUsageType:       cli.budgetUsageType,
+		BudgetRules:           cli.budgetRules,
+		BudgetTags:            cli.budgetTags,
+		MaintenanceScope:      cli.maintenanceScope,
+		MaintenanceWindow:     cli.maintenanceWindow,
+		NomadDefaultPolicy:    cli.nomadDefaultPolicy,
+		JournalFile:           cli.journalFile,
+		CacheDir:              cli.cacheDir,
+		RefreshCache:          cli.refreshCache,
+		MetricsTrapURL:        cli.metricsTrapURL,
 	}
 
 	circonusClient, err := setupCirconusClient(cli)
 	if err != nil {
 		return nil, errwrap.Wrapf("unable to setup Circonus client: {{err}}", err)
 	}
-	c.circonusClient = circonusClient
+	cfg.CirconusClient = circonusClient
 
-	if cli.mode == "consul/nomad" {
-		consulClient, err := setupConsulClient(cli)
-		if err != nil {
-			return nil, errwrap.Wrapf("unable to setup Nomad client: {{err}}", err)
-		}
-		c.consulClient = consulClient
+	reapHosts := cli.mode == reaper.ModeHosts || cli.mode == reaper.ModeConsulNomad
+	reapAllocs := cli.mode == reaper.ModeAllocs || cli.mode == reaper.ModeConsulNomad
 
-		nomadClient, err := setupNomadClient(cli)
+	var consulClient *consulapi.Client
+	if reapHosts || cli.stateConsulKey != "" {
+		consulClient, err = setupConsulClient(cli)
 		if err != nil {
-			return nil, errwrap.Wrapf("unable to setup Nomad client: {{err}}", err)
+			return nil, errwrap.Wrapf("unable to setup Consul client: {{err}}", err)
 		}
-		c.nomadClient = nomadClient
 	}
 
-	c.excludeTargets = make(map[string]bool, len(cli.excludedTargets))
-	for _, v := range cli.excludedTargets {
-		c.excludeTargets[v] = true
+	if reapHosts {
+		cfg.Hosts = reaper.NewConsulInventory(consulClient)
 	}
 
-	if err := c.Validate(); err != nil {
-		return nil, errwrap.Wrapf("client state does not validate: {{err}}", err)
+	switch {
+	case cli.stateFile != "":
+		cfg.State = reaper.NewFileStateStore(cli.stateFile)
+	case cli.stateConsulKey != "":
+		cfg.State = reaper.NewConsulStateStore(consulClient.KV(), cli.stateConsulKey)
 	}
 
-	return c, nil
+	if reapAllocs || (cli.mode == reaper.ModeBudget && containsString(cli.budgetRules, reaper.BudgetRuleNomad)) {
+		nomadClient, err := setupNomadClient(cli)
+		if err != nil {
+			return nil, errwrap.Wrapf("unable to setup Nomad client: {{err}}", err)
+		}
+		cfg.Allocs = reaper.NewNomadInventory(nomadClient)
+	}
+
+	return reaper.New(cfg)
 }
 
+// setupCirconusClient creates the Circonus client.  Unlike the Consul and
+// Nomad clients it can't be given an HTTP timeout: the vendored client builds
+// a new retrying HTTP client for every request.
 func setupCirconusClient(cli *cliConfig) (*circonusapi.API, error) {
 	cfg := &circonusapi.Config{
 		Debug:    false,
@@ -106,6 +258,7 @@ func setupConsulClient(cli *cliConfig) (*consulapi.Client, error) {
 	if cli.consulAddr != nil && *cli.consulAddr != "" {
 		consulConfig.Address = *cli.consulAddr
 	}
+	consulConfig.HttpClient.Timeout = reaper.HTTPClientTimeout(cli.requestTimeout, cli.watch)
 
 	consulClient, err := consulapi.NewClient(consulConfig)
 	if err != nil {
@@ -120,6 +273,7 @@ func setupNomadClient(cli *cliConfig) (*nomadapi.Client, error) {
 	if cli.nomadAddr != nil && *cli.nomadAddr != "" {
 		nomadConfig.Address = *cli.nomadAddr
 	}
+	nomadConfig.HttpClient.Timeout = reaper.HTTPClientTimeout(cli.requestTimeout, cli.watch)
 
 	nomadClient, err := nomadapi.NewClient(nomadConfig)
 	if err != nil {
@@ -0,0 +1,109 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/hashicorp/errwrap"
+)
+
+// maxAnnotationTargets caps the number of targets listed in the run
+// annotation's description.
+const maxAnnotationTargets = 50
+
+// annotateRun posts a Circonus annotation summarizing what the run deactivated.
+// When per-target annotations are enabled, an additional annotation is posted
+// for every deactivated target.  Dry runs and runs that changed nothing are
+// not annotated.
+func (c *Reaper) annotateRun(ctx context.Context) error {
+	if !c.annotate || c.dryRun {
+		return nil
+	}
+
+	// Only what was actually deactivated is annotated, not every target or
+	// metric the run decided to deactivate.
+	targets := c.deactivatedTargets
+	var numMetrics int
+	for _, metricNames := range targets {
+		numMetrics += len(metricNames)
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	targetNames := make([]string, 0, len(targets))
+	for target := range targets {
+		targetNames = append(targetNames, target)
+	}
+	sort.Strings(targetNames)
+
+	start := uint(c.report.Run.Start.Unix())
+	stop := uint(time.Now().Unix())
+
+	listed := targetNames
+	if len(listed) > maxAnnotationTargets {
+		listed = listed[:maxAnnotationTargets]
+	}
+	description := fmt.Sprintf("circonus-reaper run %s (mode %s) deactivated %d metrics across %d targets: %s",
+		c.runID, c.mode, numMetrics, len(targetNames), strings.Join(listed, ", "))
+	if len(listed) < len(targetNames) {
+		description += fmt.Sprintf(" and %d more", len(targetNames)-len(listed))
+	}
+
+	annotations := []*circonusapi.Annotation{{
+		Category:       c.annotationCategory,
+		Description:    description,
+		RelatedMetrics: []string{},
+		Start:          start,
+		Stop:           stop,
+		Title:          fmt.Sprintf("circonus-reaper deactivated %d targets", len(targetNames)),
+	}}
+
+	if c.annotatePerTarget {
+		for _, target := range targetNames {
+			metricNames := targets[target]
+			description := fmt.Sprintf("circonus-reaper run %s deactivated the check bundles for %s", c.runID, target)
+			if len(metricNames) > 0 {
+				description = fmt.Sprintf("circonus-reaper run %s deactivated %d metrics on %s: %s",
+					c.runID, len(metricNames), target, strings.Join(metricNames, ", "))
+			}
+
+			annotations = append(annotations, &circonusapi.Annotation{
+				Category:       c.annotationCategory,
+				Description:    description,
+				RelatedMetrics: []string{},
+				Start:          start,
+				Stop:           stop,
+				Title:          fmt.Sprintf("circonus-reaper deactivated %s", target),
+			})
+		}
+	}
+
+	for _, annotation := range annotations {
+		var created *circonusapi.Annotation
+		apiStart := time.Now()
+		err := c.updateCall(ctx, func() (err error) {
+			created, err = c.circonusClient.CreateAnnotation(annotation)
+			return err
+		})
+		c.observeAPICall("CreateAnnotation", apiStart, err)
+
+		var cid string
+		if created != nil {
+			cid = created.CID
+		}
+		c.report.addAPICall("CreateAnnotation", cid, false, err)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to create annotation %q: {{err}}", annotation.Title), err)
+		}
+
+		c.log.Info("created annotation", "annotation_cid", cid, "title", annotation.Title)
+	}
+
+	return nil
+}
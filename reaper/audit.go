@@ -0,0 +1,411 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+	"github.com/ryanuber/columnize"
+)
+
+const unknownOwner = "unknown"
+
+// ownerTagPrefix marks the tag naming the owner of a graph or worksheet.  The
+// API doesn't record who created either.
+const ownerTagPrefix = "owner:"
+
+// metricLiveness caches whether the metrics on a check are still active.
+type metricLiveness struct {
+	checkActive bool
+	statuses    map[string]string
+}
+
+// auditVisualizations scans every graph, dashboard and worksheet for
+// datapoints that reference metrics which are no longer active, either because
+// they were deactivated during this run or because their check or metric is
+// not active in Circonus.  Broken visualizations are added to the run report.
+// If enabled, dead datapoints are removed from graphs.
+func (c *Reaper) auditVisualizations(ctx context.Context) error {
+	c.livenessCache = make(map[string]*metricLiveness)
+	c.checkUUIDCache = make(map[string]string)
+
+	var graphs *[]circonusapi.Graph
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		graphs, err = c.circonusClient.FetchGraphs()
+		return err
+	})
+	c.observeAPICall("FetchGraphs", start, err)
+	c.report.addAPICall("FetchGraphs", config.GraphPrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to fetch graphs: {{err}}", err)
+	}
+
+	brokenGraphs := make(map[string]struct{})
+	if graphs != nil {
+		for i := range *graphs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			graph := &(*graphs)[i]
+
+			var dead []string
+			live := make([]circonusapi.GraphDatapoint, 0, len(graph.Datapoints))
+			for _, dp := range graph.Datapoints {
+				if dp.CheckID == 0 || dp.MetricName == "" {
+					// CAQL and formula datapoints don't reference a single metric
+					live = append(live, dp)
+					continue
+				}
+
+				checkCID := fmt.Sprintf("%s/%d", config.CheckPrefix, dp.CheckID)
+				if c.metricIsLive(ctx, checkCID, dp.MetricName) {
+					live = append(live, dp)
+					continue
+				}
+				dead = append(dead, fmt.Sprintf("%s`%s", checkCID, dp.MetricName))
+			}
+
+			if len(dead) == 0 {
+				continue
+			}
+
+			owner := ownerFromTags(graph.Tags)
+			brokenGraphs[graph.CID] = struct{}{}
+			c.stats.BrokenVisualizations++
+			c.report.addVisualization("graph", graph.CID, graph.Title, owner, dead)
+			c.log.Info("found graph referencing inactive metrics", "graph_cid", graph.CID, "title", graph.Title, "owner", owner, "dead_datapoints", len(dead))
+
+			if c.auditRemoveDatapoints && graphHasFormulas(graph) {
+				// NOTE(sean@): formulas refer to datapoints by their position, so
+				// removing a datapoint would silently point them at another one.
+				c.log.Warn("not removing dead datapoints from graph with formulas", "graph_cid", graph.CID, "title", graph.Title, "action", decisionSkip)
+				continue
+			}
+
+			if c.auditRemoveDatapoints {
+				if err := c.removeDeadDatapoints(ctx, graph, live); err != nil {
+					c.log.Error("unable to remove dead datapoints from graph", "graph_cid", graph.CID, "error", err)
+					c.recordFailure(failureKindGraph, graph.CID, err)
+				}
+			}
+		}
+	}
+
+	var dashboards *[]circonusapi.Dashboard
+	start = time.Now()
+	err = c.apiCall(ctx, func() (err error) {
+		dashboards, err = c.circonusClient.FetchDashboards()
+		return err
+	})
+	c.observeAPICall("FetchDashboards", start, err)
+	c.report.addAPICall("FetchDashboards", config.DashboardPrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to fetch dashboards: {{err}}", err)
+	}
+
+	if dashboards != nil {
+		for _, dashboard := range *dashboards {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var dead []string
+			for _, widget := range dashboard.Widgets {
+				settings := widget.Settings
+
+				if settings.GraphUUID != "" {
+					graphCID := fmt.Sprintf("%s/%s", config.GraphPrefix, settings.GraphUUID)
+					if _, found := brokenGraphs[graphCID]; found {
+						dead = append(dead, fmt.Sprintf("widget %s: %s", widget.WidgetID, graphCID))
+					}
+				}
+
+				for _, dp := range settings.Datapoints {
+					if dp.CheckID == 0 || dp.Metric == "" {
+						continue
+					}
+
+					checkCID := fmt.Sprintf("%s/%d", config.CheckPrefix, dp.CheckID)
+					if !c.metricIsLive(ctx, checkCID, dp.Metric) {
+						dead = append(dead, fmt.Sprintf("widget %s: %s`%s", widget.WidgetID, checkCID, dp.Metric))
+					}
+				}
+
+				if settings.CheckUUID != "" && settings.MetricName != "" {
+					checkCID, err := c.checkCIDByUUID(ctx, settings.CheckUUID)
+					if err != nil {
+						c.log.Error("unable to look up check by UUID", "dashboard_cid", dashboard.CID, "check_uuid", settings.CheckUUID, "error", err)
+						c.recordFailure(failureKindDashboard, dashboard.CID, err)
+						continue
+					}
+					if checkCID == "" || !c.metricIsLive(ctx, checkCID, settings.MetricName) {
+						dead = append(dead, fmt.Sprintf("widget %s: %s`%s", widget.WidgetID, settings.CheckUUID, settings.MetricName))
+					}
+				}
+			}
+
+			if len(dead) == 0 {
+				continue
+			}
+
+			owner := dashboard.CreatedBy
+			if owner == "" {
+				owner = unknownOwner
+			}
+
+			c.stats.BrokenVisualizations++
+			c.report.addVisualization("dashboard", dashboard.CID, dashboard.Title, owner, dead)
+			c.log.Info("found dashboard referencing inactive metrics", "dashboard_cid", dashboard.CID, "title", dashboard.Title, "owner", owner, "dead_datapoints", len(dead))
+		}
+	}
+
+	var worksheets *[]circonusapi.Worksheet
+	start = time.Now()
+	err = c.apiCall(ctx, func() (err error) {
+		worksheets, err = c.circonusClient.FetchWorksheets()
+		return err
+	})
+	c.observeAPICall("FetchWorksheets", start, err)
+	c.report.addAPICall("FetchWorksheets", config.WorksheetPrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to fetch worksheets: {{err}}", err)
+	}
+
+	if worksheets != nil {
+		for _, worksheet := range *worksheets {
+			var dead []string
+			for _, graph := range worksheet.Graphs {
+				if _, found := brokenGraphs[graph.GraphCID]; found {
+					dead = append(dead, graph.GraphCID)
+				}
+			}
+
+			if len(dead) == 0 {
+				continue
+			}
+
+			owner := ownerFromTags(worksheet.Tags)
+			c.stats.BrokenVisualizations++
+			c.report.addVisualization("worksheet", worksheet.CID, worksheet.Title, owner, dead)
+			c.log.Info("found worksheet containing broken graphs", "worksheet_cid", worksheet.CID, "title", worksheet.Title, "owner", owner, "broken_graphs", len(dead))
+		}
+	}
+
+	return nil
+}
+
+// ownerFromTags returns the owner named by an owner:<name> tag, or
+// unknownOwner if there is none.
+func ownerFromTags(tags []string) string {
+	for _, tag := range tags {
+		if len(tag) > len(ownerTagPrefix) && strings.EqualFold(tag[:len(ownerTagPrefix)], ownerTagPrefix) {
+			return tag[len(ownerTagPrefix):]
+		}
+	}
+
+	return unknownOwner
+}
+
+// graphHasFormulas returns true if any datapoint, composite or guide of the
+// graph has a data formula.
+func graphHasFormulas(graph *circonusapi.Graph) bool {
+	for _, dp := range graph.Datapoints {
+		if dp.DataFormula != nil && *dp.DataFormula != "" {
+			return true
+		}
+	}
+	for _, composite := range graph.Composites {
+		if composite.DataFormula != nil && *composite.DataFormula != "" {
+			return true
+		}
+	}
+	for _, guide := range graph.Guides {
+		if guide.DataFormula != nil && *guide.DataFormula != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// metricIsLive returns true if the metric is active on an active check and
+// wasn't deactivated during this run.  A check that no longer exists is dead.
+// Other lookup failures are logged and treated as live so that an API hiccup
+// never marks a datapoint as dead.
+func (c *Reaper) metricIsLive(ctx context.Context, checkCID, metricName string) bool {
+	if reaped, found := c.reapedMetrics[checkCID]; found {
+		if reaped == nil {
+			return false
+		}
+		if _, found := reaped[metricName]; found {
+			return false
+		}
+	}
+
+	liveness, found := c.livenessCache[checkCID]
+	if !found {
+		var err error
+		liveness, err = c.fetchMetricLiveness(ctx, checkCID)
+		if err != nil {
+			c.log.Error("unable to determine metric liveness", "check_cid", checkCID, "error", err)
+			c.recordFailure(failureKindCheck, checkCID, err)
+			return true
+		}
+		c.livenessCache[checkCID] = liveness
+	}
+
+	if !liveness.checkActive {
+		return false
+	}
+
+	return liveness.statuses[metricName] == "active"
+}
+
+func (c *Reaper) fetchMetricLiveness(ctx context.Context, checkCID string) (*metricLiveness, error) {
+	var check *circonusapi.Check
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		check, err = c.circonusClient.FetchCheck(circonusapi.CIDType(&checkCID))
+		return err
+	})
+	c.observeAPICall("FetchCheck", start, err)
+	c.report.addAPICall("FetchCheck", checkCID, false, err)
+	if err != nil && isNotFound(err) {
+		return &metricLiveness{}, nil
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to fetch check %q: {{err}}", checkCID), err)
+	}
+
+	liveness := &metricLiveness{
+		checkActive: check.Active,
+		statuses:    make(map[string]string),
+	}
+	if !check.Active {
+		return liveness, nil
+	}
+
+	checkBundleMD := checkBundleCIDRE.FindStringSubmatch(check.CheckBundleCID)
+	if checkBundleMD == nil || len(checkBundleMD) < 3 {
+		return nil, fmt.Errorf("unable to extract CID from %q", check.CheckBundleCID)
+	}
+	checkBundleMetricsCID := fmt.Sprintf("%s/%s", config.CheckBundleMetricsPrefix, checkBundleMD[2])
+
+	var cbm *circonusapi.CheckBundleMetrics
+	start = time.Now()
+	err = c.apiCall(ctx, func() (err error) {
+		cbm, err = c.circonusClient.FetchCheckBundleMetrics(circonusapi.CIDType(&checkBundleMetricsCID))
+		return err
+	})
+	c.observeAPICall("FetchCheckBundleMetrics", start, err)
+	c.report.addAPICall("FetchCheckBundleMetrics", checkBundleMetricsCID, false, err)
+	if err != nil && isNotFound(err) {
+		liveness.checkActive = false
+		return liveness, nil
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to fetch check bundle metrics %q: {{err}}", checkBundleMetricsCID), err)
+	}
+
+	for _, metric := range cbm.Metrics {
+		liveness.statuses[metric.Name] = metric.Status
+	}
+
+	return liveness, nil
+}
+
+func (c *Reaper) checkCIDByUUID(ctx context.Context, checkUUID string) (string, error) {
+	if checkCID, found := c.checkUUIDCache[checkUUID]; found {
+		return checkCID, nil
+	}
+
+	filter := circonusapi.SearchFilterType{
+		"f__check_uuid": []string{checkUUID},
+	}
+	var checks *[]circonusapi.Check
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		checks, err = c.circonusClient.SearchChecks(nil, &filter)
+		return err
+	})
+	c.observeAPICall("SearchChecks", start, err)
+	c.report.addAPICall("SearchChecks", checkUUID, false, err)
+	if err != nil {
+		return "", errwrap.Wrapf(fmt.Sprintf("unable to search for check %q: {{err}}", checkUUID), err)
+	}
+
+	var checkCID string
+	if checks != nil && len(*checks) > 0 {
+		checkCID = (*checks)[0].CID
+	}
+	c.checkUUIDCache[checkUUID] = checkCID
+
+	return checkCID, nil
+}
+
+func (c *Reaper) removeDeadDatapoints(ctx context.Context, graph *circonusapi.Graph, live []circonusapi.GraphDatapoint) error {
+	if c.dryRun {
+		c.log.Info("dry-run: about to remove dead datapoints from graph", "graph_cid", graph.CID, "action", decisionDeactivate)
+		c.report.addAPICall("UpdateGraph", graph.CID, true, nil)
+		return nil
+	}
+
+	ctx, err := c.beginUpdate(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := c.journal.Record(c.runID, "update", "graph", graph.CID, graph); err != nil {
+		return errwrap.Wrapf("unable to journal graph: {{err}}", err)
+	}
+
+	updated := *graph
+	updated.Datapoints = live
+
+	c.log.Info("removing dead datapoints from graph", "graph_cid", graph.CID, "action", decisionDeactivate)
+	start := time.Now()
+	err = c.updateCall(ctx, func() error {
+		_, err := c.circonusClient.UpdateGraph(&updated)
+		return err
+	})
+	c.observeAPICall("UpdateGraph", start, err)
+	c.report.addAPICall("UpdateGraph", graph.CID, false, err)
+
+	return err
+}
+
+// printVisualizations writes the broken visualizations in the report grouped
+// by owner.
+func (r *Report) printVisualizations(w io.Writer) {
+	if len(r.Visualizations) == 0 {
+		return
+	}
+
+	byOwner := make(map[string][]ReportVisualization)
+	for _, v := range r.Visualizations {
+		byOwner[v.Owner] = append(byOwner[v.Owner], v)
+	}
+
+	owners := make([]string, 0, len(byOwner))
+	for owner := range byOwner {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	fmt.Fprintln(w, "Broken Visualizations:")
+	output := []string{"Owner | Type | CID | Title | Dead References"}
+	for _, owner := range owners {
+		for _, v := range byOwner[owner] {
+			output = append(output, fmt.Sprintf("%s | %s | %s | %s | %s", owner, v.Type, v.CID, v.Title, strings.Join(v.DeadReferences, ", ")))
+		}
+	}
+	fmt.Fprintln(w, columnize.SimpleFormat(output))
+}
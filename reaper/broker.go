@@ -0,0 +1,219 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+	"github.com/ryanuber/columnize"
+)
+
+// Policies for check bundles whose brokers are all gone or inactive.
+const (
+	BrokerPolicyReport     = "report"
+	BrokerPolicyReassign   = "reassign"
+	BrokerPolicyDeactivate = "deactivate"
+)
+
+const brokerStatusGone = "gone"
+
+// brokerStatus returns "active" if any of the broker's instances are active,
+// otherwise the status of its first instance.
+func brokerStatus(broker *circonusapi.Broker) string {
+	status := "unknown"
+	for i, detail := range broker.Details {
+		if detail.Status == "active" {
+			return detail.Status
+		}
+		if i == 0 && detail.Status != "" {
+			status = detail.Status
+		}
+	}
+
+	return status
+}
+
+// reapOrphanedBrokerBundles finds active check bundles whose brokers have all
+// been decommissioned or are not active and reports, reassigns or deactivates
+// them according to the configured policy.
+func (c *Reaper) reapOrphanedBrokerBundles(ctx context.Context) error {
+	var brokers *[]circonusapi.Broker
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		brokers, err = c.circonusClient.FetchBrokers()
+		return err
+	})
+	c.observeAPICall("FetchBrokers", start, err)
+	c.report.addAPICall("FetchBrokers", config.BrokerPrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to fetch brokers: {{err}}", err)
+	}
+
+	brokerStatuses := make(map[string]string)
+	if brokers != nil {
+		for i := range *brokers {
+			broker := &(*brokers)[i]
+			brokerStatuses[broker.CID] = brokerStatus(broker)
+		}
+	}
+
+	if c.brokerPolicy == BrokerPolicyReassign {
+		if status := brokerStatuses[c.replacementBroker]; status != "active" {
+			return fmt.Errorf("replacement broker %q is not active (status %q)", c.replacementBroker, status)
+		}
+	}
+
+	searchQuery := circonusapi.SearchQueryType("(active:1)")
+	filterCriteria := map[string][]string{}
+	var checkBundles *[]circonusapi.CheckBundle
+	start = time.Now()
+	err = c.apiCall(ctx, func() (err error) {
+		checkBundles, err = c.circonusClient.SearchCheckBundles(&searchQuery, &filterCriteria)
+		return err
+	})
+	c.observeAPICall("SearchCheckBundles", start, err)
+	c.report.addAPICall("SearchCheckBundles", config.CheckBundlePrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to search Circonus: {{err}}", err)
+	}
+
+	if checkBundles == nil {
+		return nil
+	}
+
+	for i := range *checkBundles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		checkBundle := &(*checkBundles)[i]
+		if len(checkBundle.Brokers) == 0 {
+			continue
+		}
+
+		var orphaned = true
+		for _, brokerCID := range checkBundle.Brokers {
+			if brokerStatuses[brokerCID] == "active" {
+				orphaned = false
+				break
+			}
+		}
+
+		if !orphaned {
+			continue
+		}
+
+		if c.excludeTarget(checkBundle.Target) {
+			c.log.Info("skipping check bundle on inactive brokers for excluded target", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionSkip)
+			for _, brokerCID := range checkBundle.Brokers {
+				c.report.addBrokerBundle(brokerCID, brokerStatusOrGone(brokerStatuses, brokerCID), checkBundle.CID, checkBundle.Target, decisionSkip)
+			}
+			continue
+		}
+
+		c.stats.OrphanedBrokerBundles++
+		for _, brokerCID := range checkBundle.Brokers {
+			c.report.addBrokerBundle(brokerCID, brokerStatusOrGone(brokerStatuses, brokerCID), checkBundle.CID, checkBundle.Target, c.brokerPolicy)
+		}
+
+		if err := c.applyBrokerPolicy(ctx, checkBundle); err != nil {
+			c.log.Error("unable to reap check bundle on inactive brokers", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", c.brokerPolicy, "error", err)
+			c.recordFailure(failureKindCheckBundle, checkBundle.CID, err)
+
+			// NOTE(sean@): treat errors as soft, a single bundle shouldn't prevent
+			// reaping the bundles on every other broker.
+			continue
+		}
+	}
+
+	return nil
+}
+
+func brokerStatusOrGone(statuses map[string]string, brokerCID string) string {
+	if status, found := statuses[brokerCID]; found {
+		return status
+	}
+
+	return brokerStatusGone
+}
+
+func (c *Reaper) applyBrokerPolicy(ctx context.Context, checkBundle *circonusapi.CheckBundle) error {
+	log := c.log.With("target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "brokers", strings.Join(checkBundle.Brokers, ","), "action", c.brokerPolicy)
+
+	if c.brokerPolicy == BrokerPolicyReport {
+		log.Info("found check bundle whose brokers are all gone or inactive")
+		return nil
+	}
+
+	if c.dryRun {
+		log.Info("dry-run: about to update check bundle whose brokers are all gone or inactive")
+		c.report.addAPICall("UpdateCheckBundle", checkBundle.CID, true, nil)
+		return nil
+	}
+
+	ctx, err := c.beginUpdate(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := c.journal.Record(c.runID, c.brokerPolicy, "check_bundle", checkBundle.CID, checkBundle); err != nil {
+		return errwrap.Wrapf("unable to journal check bundle: {{err}}", err)
+	}
+
+	updated := *checkBundle
+	switch c.brokerPolicy {
+	case BrokerPolicyReassign:
+		updated.Brokers = []string{c.replacementBroker}
+	case BrokerPolicyDeactivate:
+		updated.Status = "disabled"
+	default:
+		return fmt.Errorf("unsupported broker policy: %q", c.brokerPolicy)
+	}
+
+	log.Info("updating check bundle whose brokers are all gone or inactive", "replacement_broker", c.replacementBroker)
+
+	return c.withMaintenance(ctx, checkBundle.Target, checkBundle.Checks, func() error {
+		start := time.Now()
+		err := c.updateCall(ctx, func() error {
+			_, err := c.circonusClient.UpdateCheckBundle(&updated)
+			return err
+		})
+		c.observeAPICall("UpdateCheckBundle", start, err)
+		c.report.addAPICall("UpdateCheckBundle", checkBundle.CID, false, err)
+		return err
+	})
+}
+
+// printBrokerBundles writes the check bundles on inactive brokers in the
+// report grouped by broker.
+func (r *Report) printBrokerBundles(w io.Writer) {
+	if len(r.BrokerBundles) == 0 {
+		return
+	}
+
+	byBroker := make(map[string][]ReportBrokerBundle)
+	for _, b := range r.BrokerBundles {
+		byBroker[b.Broker] = append(byBroker[b.Broker], b)
+	}
+
+	brokerCIDs := make([]string, 0, len(byBroker))
+	for brokerCID := range byBroker {
+		brokerCIDs = append(brokerCIDs, brokerCID)
+	}
+	sort.Strings(brokerCIDs)
+
+	fmt.Fprintln(w, "Check Bundles on Inactive Brokers:")
+	output := []string{"Broker | Broker Status | Check Bundle | Target | Action"}
+	for _, brokerCID := range brokerCIDs {
+		for _, b := range byBroker[brokerCID] {
+			output = append(output, fmt.Sprintf("%s | %s | %s | %s | %s", b.Broker, b.BrokerStatus, b.CheckBundleCID, b.Target, b.Action))
+		}
+	}
+	fmt.Fprintln(w, columnize.SimpleFormat(output))
+}
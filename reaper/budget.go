@@ -0,0 +1,409 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+	"github.com/ryanuber/columnize"
+)
+
+// Rules used to rank metrics for shedding when over the metric budget.
+const (
+	BudgetRuleStale = "stale"
+	BudgetRuleNomad = "nomad"
+	BudgetRuleTags  = "tags"
+)
+
+// nomadAllocMetricRE matches the job and alloc ID of a Nomad alloc metric.
+var nomadAllocMetricRE = regexp.MustCompile(fmt.Sprintf("(?i)^nomad`[^`]+`client`allocs`([^`]+)`.*`%s`", `([\da-f]{8}-[\da-f]{4}-[\da-f]{4}-[\da-f]{4}-[\da-f]{12})`))
+
+// shedCandidate is an active metric that may be deactivated to get back under
+// the metric budget.
+type shedCandidate struct {
+	metric circonusapi.Metric
+	rule   string
+	reason string
+}
+
+// shedRanking is the state of ranking the active metrics for shedding.  It is
+// kept across rounds so that no metric is ranked, or has its data fetched,
+// twice.
+type shedRanking struct {
+	metrics    []circonusapi.Metric
+	seen       map[string]struct{}
+	hasData    map[string]struct{}
+	fetched    uint
+	liveAllocs map[string]struct{}
+}
+
+// enforceMetricBudget compares the account's active metric usage with the
+// budget and, when over, deactivates just enough metrics to get back under it.
+// Candidates are ranked by the configured budget rules, in order.
+func (c *Reaper) enforceMetricBudget(ctx context.Context) error {
+	var account *circonusapi.Account
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		account, err = c.circonusClient.FetchAccount(nil)
+		return err
+	})
+	c.observeAPICall("FetchAccount", start, err)
+	c.report.addAPICall("FetchAccount", config.AccountPrefix+"/current", false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to fetch account: {{err}}", err)
+	}
+
+	var usage *circonusapi.AccountLimit
+	for i := range account.Usage {
+		if strings.EqualFold(account.Usage[i].Type, c.budgetUsageType) {
+			usage = &account.Usage[i]
+			break
+		}
+	}
+	if usage == nil {
+		return fmt.Errorf("account %q has no %q usage", account.CID, c.budgetUsageType)
+	}
+
+	budget := c.metricBudget
+	if budget == 0 {
+		budget = usage.Limit
+	}
+
+	c.report.setBudget(usage.Type, usage.Limit, usage.Used, budget)
+	log := c.log.With("usage_type", usage.Type, "limit", usage.Limit, "used", usage.Used, "budget", budget)
+
+	if usage.Used <= budget {
+		log.Info("metric usage is within budget")
+		return nil
+	}
+
+	over := usage.Used - budget
+	log.Info("metric usage is over budget", "over", over)
+
+	ranking, err := c.newShedRanking(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Candidates on excluded targets, or whose bundle fails to update, aren't
+	// shed, so more are ranked until enough metrics were actually shed.
+	var shed uint
+	for shed < over {
+		candidates, err := c.rankShedCandidates(ctx, ranking, over-shed)
+		if err != nil {
+			return err
+		}
+		if len(candidates) == 0 {
+			break
+		}
+
+		n, err := c.shedCandidates(ctx, candidates)
+		shed += n
+		if err != nil {
+			return err
+		}
+	}
+
+	if shed < over {
+		log.Warn("not enough reapable metrics to get under budget", "over", over, "shed", shed)
+	}
+
+	return nil
+}
+
+// shedCandidates deactivates the candidates and returns how many of them were
+// deactivated.
+func (c *Reaper) shedCandidates(ctx context.Context, candidates []shedCandidate) (uint, error) {
+	// Group the candidates by check bundle so each bundle is updated once.
+	byCheckBundle := make(map[string][]shedCandidate)
+	for _, candidate := range candidates {
+		byCheckBundle[candidate.metric.CheckBundleCID] = append(byCheckBundle[candidate.metric.CheckBundleCID], candidate)
+	}
+
+	checkBundleCIDs := make([]string, 0, len(byCheckBundle))
+	for checkBundleCID := range byCheckBundle {
+		checkBundleCIDs = append(checkBundleCIDs, checkBundleCID)
+	}
+	sort.Strings(checkBundleCIDs)
+
+	var shed uint
+	for _, checkBundleCID := range checkBundleCIDs {
+		if err := ctx.Err(); err != nil {
+			return shed, err
+		}
+
+		n, err := c.shedBundleMetrics(ctx, checkBundleCID, byCheckBundle[checkBundleCID])
+		if err != nil {
+			c.log.Error("unable to shed metrics", "check_bundle_cid", checkBundleCID, "error", err)
+			c.recordFailure(failureKindCheckBundle, checkBundleCID, err)
+
+			// NOTE(sean@): treat errors as soft because we want to try updating
+			// check_bundle_metrics for all bundles vs getting hung up on a
+			// single bundle that may be failing for some reason.
+			continue
+		}
+		shed += n
+	}
+
+	return shed, nil
+}
+
+// newShedRanking searches for the active metrics to rank.
+func (c *Reaper) newShedRanking(ctx context.Context) (*shedRanking, error) {
+	metrics, err := c.searchAllMetrics(ctx, "(active:1)")
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to search Circonus for active metrics: {{err}}", err)
+	}
+
+	return &shedRanking{
+		metrics: shuffledMetrics(metrics),
+		seen:    make(map[string]struct{}),
+		hasData: make(map[string]struct{}),
+	}, nil
+}
+
+// rankShedCandidates walks the active metrics not yet ranked once per budget
+// rule and returns at most limit candidates, ranked by rule order.
+func (c *Reaper) rankShedCandidates(ctx context.Context, r *shedRanking, limit uint) ([]shedCandidate, error) {
+	candidates := make([]shedCandidate, 0, limit)
+	add := func(metric circonusapi.Metric, rule, reason string) bool {
+		if _, found := r.seen[metric.CID]; found {
+			return false
+		}
+		r.seen[metric.CID] = struct{}{}
+		candidates = append(candidates, shedCandidate{metric: metric, rule: rule, reason: reason})
+		return uint(len(candidates)) >= limit
+	}
+
+	for _, rule := range c.budgetRules {
+		switch rule {
+		case BudgetRuleStale:
+			now := time.Now()
+			since := now.Add(-c.staleAfter)
+			for i, metric := range r.metrics {
+				if _, found := r.seen[metric.CID]; found || !metric.CheckActive {
+					continue
+				}
+				if _, found := r.hasData[metric.CID]; found {
+					continue
+				}
+
+				if r.fetched >= c.staleMaxMetrics {
+					c.log.Warn("stale metric limit reached, the remaining metrics are checked in a later run", "limit", c.staleMaxMetrics, "remaining", len(r.metrics)-i)
+					break
+				}
+				r.fetched++
+
+				lastData, err := c.fetchLastDataPoint(ctx, &metric, since, now)
+				if err != nil {
+					c.log.Error("unable to fetch metric data", "check_bundle_cid", metric.CheckBundleCID, "metric", metric.MetricName, "error", err)
+					c.recordFailure(failureKindMetric, metric.CID, err)
+					r.hasData[metric.CID] = struct{}{}
+					continue
+				}
+				if !lastData.IsZero() {
+					r.hasData[metric.CID] = struct{}{}
+					continue
+				}
+
+				if add(metric, rule, fmt.Sprintf("no data for %s", c.staleAfter)) {
+					return candidates, nil
+				}
+			}
+		case BudgetRuleNomad:
+			if r.liveAllocs == nil {
+				liveAllocs, err := c.findLiveAllocIDs(ctx)
+				if err != nil {
+					return nil, err
+				}
+				r.liveAllocs = liveAllocs
+			}
+
+			for _, metric := range r.metrics {
+				if _, found := r.seen[metric.CID]; found {
+					continue
+				}
+
+				allocMD := nomadAllocMetricRE.FindStringSubmatch(metric.MetricName)
+				if allocMD == nil || len(allocMD) < 3 {
+					continue
+				}
+				jobID, allocID := allocMD[1], strings.ToLower(allocMD[2])
+				if _, found := r.liveAllocs[allocID]; found {
+					continue
+				}
+
+				// The job's policy applies to shedding as it does to reaping.
+				reapable, reason, err := c.allocReapable(ctx, jobID, allocID)
+				if err != nil {
+					c.log.Error("unable to look up job policy, keeping metric", "check_bundle_cid", metric.CheckBundleCID, "metric", metric.MetricName, "alloc_id", allocID, "error", err)
+					c.recordFailure(failureKindAlloc, allocID, err)
+					r.seen[metric.CID] = struct{}{}
+					continue
+				}
+				if !reapable {
+					c.log.Debug("keeping metric per job policy", "check_bundle_cid", metric.CheckBundleCID, "metric", metric.MetricName, "job", jobID, "reason", reason, "action", decisionSkip)
+					r.seen[metric.CID] = struct{}{}
+					continue
+				}
+
+				if add(metric, rule, reasonOrphanedAlloc) {
+					return candidates, nil
+				}
+			}
+		case BudgetRuleTags:
+			for _, metric := range r.metrics {
+				tag := c.lowPriorityTag(&metric)
+				if tag == "" {
+					continue
+				}
+
+				if add(metric, rule, fmt.Sprintf("tagged %s", tag)) {
+					return candidates, nil
+				}
+			}
+		}
+	}
+
+	return candidates, nil
+}
+
+// findLiveAllocIDs returns the IDs of every Nomad allocation that is pending or
+// running.  Allocations that are finished or have been garbage collected are
+// not included.
+func (c *Reaper) findLiveAllocIDs(ctx context.Context) (map[string]struct{}, error) {
+	if c.allocs == nil {
+		return nil, fmt.Errorf("Nomad alloc inventory can not be nil with budget rule %q", BudgetRuleNomad)
+	}
+
+	var allocList []string
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		allocList, err = c.allocs.LiveAllocs(ctx)
+		return err
+	})
+	c.observeAPICall("NomadAllocations", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	allocIDs := make(map[string]struct{}, len(allocList))
+	for _, allocID := range allocList {
+		allocIDs[strings.ToLower(allocID)] = struct{}{}
+	}
+
+	return allocIDs, nil
+}
+
+// lowPriorityTag returns the first configured low-priority tag found on the
+// metric or its check, or the empty string if there is none.
+func (c *Reaper) lowPriorityTag(metric *circonusapi.Metric) string {
+	for _, tag := range c.budgetTags {
+		for _, metricTag := range metric.Tags {
+			if metricTag == tag {
+				return tag
+			}
+		}
+		for _, checkTag := range metric.CheckTags {
+			if checkTag == tag {
+				return tag
+			}
+		}
+	}
+
+	return ""
+}
+
+// shedBundleMetrics deactivates the candidates on a single check bundle and
+// returns how many were deactivated.
+func (c *Reaper) shedBundleMetrics(ctx context.Context, checkBundleCID string, candidates []shedCandidate) (uint, error) {
+	checkBundle, err := c.fetchCheckBundle(ctx, checkBundleCID)
+	if err != nil {
+		return 0, err
+	}
+
+	target := checkBundle.Target
+	if c.excludeTarget(target) {
+		c.log.Info("skipping metrics on excluded target", "target", target, "check_bundle_cid", checkBundleCID, "action", decisionSkip)
+		for _, candidate := range candidates {
+			c.report.addMetric(target, checkBundleCID, candidate.metric.MetricName, "active", decisionSkip, reasonExcluded)
+		}
+		return 0, nil
+	}
+
+	byName := make(map[string]shedCandidate, len(candidates))
+	for _, candidate := range candidates {
+		byName[candidate.metric.MetricName] = candidate
+	}
+
+	cbm, err := c.fetchCheckBundleMetrics(ctx, checkBundleCID)
+	if err != nil {
+		return 0, err
+	}
+
+	var shed []string
+	for i, metric := range cbm.Metrics {
+		candidate, found := byName[metric.Name]
+		if !found {
+			continue
+		}
+		if status, ok := c.metricStatusOf(target, checkBundleCID, &cbm.Metrics[i]); !ok || status != metricStatusActive {
+			continue
+		}
+
+		c.log.Info("shedding metric to get under budget", "target", target, "check_bundle_cid", checkBundleCID, "metric", metric.Name, "rule", candidate.rule, "reason", candidate.reason, "action", decisionDeactivate)
+		cbm.Metrics[i].Status = string(metricStatusAvailable)
+		shed = append(shed, metric.Name)
+		c.stats.ShedMetrics++
+		c.stats.DisabledMetrics++
+		c.report.addMetric(target, checkBundleCID, metric.Name, metric.Status, decisionDeactivate, candidate.reason)
+		c.report.addShedMetric(checkBundleCID, metric.Name, candidate.rule, candidate.reason)
+	}
+
+	if len(shed) == 0 {
+		return 0, nil
+	}
+
+	if err := c.updateCheckBundleMetrics(ctx, target, checkBundleCID, checkBundle.Checks, cbm); err != nil {
+		return 0, err
+	}
+
+	for _, metricName := range shed {
+		c.recordReapedMetric(target, checkBundle.Checks, metricName)
+	}
+
+	return uint(len(shed)), nil
+}
+
+// printBudget writes the metric budget and the metrics shed to meet it.
+func (r *Report) printBudget(w io.Writer) {
+	if r.Budget == nil {
+		return
+	}
+
+	fmt.Fprintln(w, "Metric Budget:")
+	fmt.Fprintln(w, columnize.SimpleFormat([]string{
+		fmt.Sprintf("Usage Type | %s", r.Budget.UsageType),
+		fmt.Sprintf("Limit | %d", r.Budget.Limit),
+		fmt.Sprintf("Used | %d", r.Budget.Used),
+		fmt.Sprintf("Budget | %d", r.Budget.Budget),
+	}))
+
+	if len(r.Budget.Shed) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "Shed Metrics:")
+	output := []string{"Rule | Check Bundle | Metric | Reason"}
+	for _, m := range r.Budget.Shed {
+		output = append(output, fmt.Sprintf("%s | %s | %s | %s", m.Rule, m.CheckBundleCID, m.Metric, m.Reason))
+	}
+	fmt.Fprintln(w, columnize.SimpleFormat(output))
+}
@@ -0,0 +1,90 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func TestEnforceMetricBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		used         uint
+		filler       int
+		web1, web2   int
+		wantShed     uint
+		wantSearches int
+	}{
+		{name: "within budget", used: 5, web1: 3},
+		{name: "enough candidates", used: 15, web1: 8, wantShed: 5, wantSearches: 1},
+		{name: "candidates on an excluded target", used: 15, web1: 2, web2: 6, wantShed: 2, wantSearches: 1},
+		{name: "no candidates", used: 15, filler: 10, wantSearches: 1},
+		{name: "candidates past the first page", used: 15, filler: metricSearchPageSize, web1: 3, wantShed: 3, wantSearches: 2},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.account = &circonusapi.Account{
+			CID:   "/account/1",
+			Usage: []circonusapi.AccountLimit{{Type: "Metric", Limit: 100, Used: test.used}},
+		}
+
+		addMetrics := func(id int, target string, n int, tags []string) {
+			var names []string
+			for i := 0; i < n; i++ {
+				name := fmt.Sprintf("m%d", i)
+				names = append(names, name)
+				f.metrics = append(f.metrics, circonusapi.Metric{
+					Active:         true,
+					CheckActive:    true,
+					CheckBundleCID: fmt.Sprintf("/check_bundle/%d", id),
+					CheckCID:       fmt.Sprintf("/check/%d", id),
+					CID:            fmt.Sprintf("/metric/%d_%s", id, name),
+					MetricName:     name,
+					Tags:           tags,
+				})
+			}
+			f.addCheckBundle(id, target, names...)
+		}
+		addMetrics(3, "web3", test.filler, nil)
+		addMetrics(1, "web1", test.web1, []string{"low"})
+		addMetrics(2, "web2", test.web2, []string{"low"})
+
+		c := newTestReaper(t, f, Config{
+			Mode:           ModeBudget,
+			MetricBudget:   10,
+			BudgetRules:    []string{BudgetRuleTags},
+			BudgetTags:     []string{"low"},
+			ExcludeTargets: []string{"web2"},
+		})
+
+		// A shedding loop that doesn't terminate fails on the deadline.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := c.enforceMetricBudget(ctx); err != nil {
+			t.Errorf("%s: enforceMetricBudget() = %v", test.name, err)
+		}
+		cancel()
+
+		if c.stats.ShedMetrics != test.wantShed {
+			t.Errorf("%s: shed %d metrics, want %d", test.name, c.stats.ShedMetrics, test.wantShed)
+		}
+		if got := f.countRequests("GET /metric?"); got != test.wantSearches {
+			t.Errorf("%s: searched %d pages, want %d", test.name, got, test.wantSearches)
+		}
+
+		var available int
+		for _, status := range f.metricStatuses("/check_bundle/2") {
+			if status != "active" {
+				available++
+			}
+		}
+		if available > 0 {
+			t.Errorf("%s: shed %d metrics on the excluded target", test.name, available)
+		}
+
+		f.Close()
+	}
+}
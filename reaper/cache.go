@@ -0,0 +1,267 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+)
+
+const cacheFileName = "check_bundles.json"
+
+// cacheSyncSkew is subtracted from the time of each sync so that bundles
+// modified while a sync is in flight, or on a server whose clock is slightly
+// behind, are picked up by the next incremental sync.
+const cacheSyncSkew = time.Minute
+
+// cacheFullSyncInterval is how often the cache is rebuilt from scratch.  An
+// incremental sync only sees bundles that still exist, so this is what drops
+// bundles that were deleted outright rather than deactivated.
+const cacheFullSyncInterval = 24 * time.Hour
+
+// bundleCache is an on-disk snapshot of the active check bundles and their
+// metric statuses.  It is refreshed incrementally by searching for bundles
+// modified since the last sync, and rebuilt every cacheFullSyncInterval.
+type bundleCache struct {
+	store StateStore
+
+	// LastSync is the Unix time bundles were last synced up to.
+	LastSync int64 `json:"last_sync"`
+
+	// LastFullSync is the Unix time the cache was last rebuilt from scratch.
+	LastFullSync int64 `json:"last_full_sync"`
+
+	// CheckBundles maps check bundle CIDs to active check bundles.
+	CheckBundles map[string]*cachedCheckBundle `json:"check_bundles"`
+}
+
+type cachedCheckBundle struct {
+	CheckBundle circonusapi.CheckBundle `json:"check_bundle"`
+
+	// Metrics are the bundle's metrics as of the bundle's _last_modified, or
+	// nil if they haven't been fetched since the bundle last changed.
+	Metrics *circonusapi.CheckBundleMetrics `json:"metrics,omitempty"`
+}
+
+func newBundleCache(dir string) (*bundleCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to create cache directory %q: {{err}}", dir), err)
+	}
+
+	cache := &bundleCache{
+		store: &fileStateStore{path: filepath.Join(dir, cacheFileName)},
+	}
+	if err := cache.store.Load(cache); err != nil {
+		return nil, errwrap.Wrapf("unable to load check bundle cache: {{err}}", err)
+	}
+	if cache.CheckBundles == nil {
+		cache.CheckBundles = make(map[string]*cachedCheckBundle)
+	}
+
+	return cache, nil
+}
+
+// saveCache writes the check bundle cache to disk.  It is a no-op if caching
+// is disabled.
+func (c *Reaper) saveCache() error {
+	if c.cache == nil {
+		return nil
+	}
+
+	return c.cache.store.Save(c.cache)
+}
+
+// syncCache brings the check bundle cache up to date, once per run.  The first
+// sync, the first sync after cacheFullSyncInterval and every sync with
+// -refresh-cache list every active bundle; other syncs only fetch bundles
+// modified since the previous sync.
+func (c *Reaper) syncCache(ctx context.Context) error {
+	if c.cacheSynced {
+		return nil
+	}
+
+	syncStart := time.Now()
+	full := c.refreshCache || c.cache.LastSync == 0 ||
+		syncStart.Sub(time.Unix(c.cache.LastFullSync, 0)) >= cacheFullSyncInterval
+
+	var searchQuery *circonusapi.SearchQueryType
+	filterCriteria := map[string][]string{}
+	if full {
+		q := circonusapi.SearchQueryType("(active:1)")
+		searchQuery = &q
+	} else {
+		filterCriteria["f__last_modified_gt"] = []string{fmt.Sprintf("%d", c.cache.LastSync)}
+	}
+
+	var checkBundles *[]circonusapi.CheckBundle
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		checkBundles, err = c.circonusClient.SearchCheckBundles(searchQuery, &filterCriteria)
+		return err
+	})
+	c.observeAPICall("SearchCheckBundles", start, err)
+	c.report.addAPICall("SearchCheckBundles", config.CheckBundlePrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to sync check bundle cache: {{err}}", err)
+	}
+
+	// Metrics fetched since a bundle last changed are still current, unless
+	// the cache is being rebuilt from scratch.
+	previous := c.cache.CheckBundles
+	if c.refreshCache {
+		previous = nil
+	}
+	if full {
+		c.cache.CheckBundles = make(map[string]*cachedCheckBundle)
+	}
+
+	var updated, removed int
+	if checkBundles != nil {
+		for _, checkBundle := range *checkBundles {
+			if checkBundle.Status != "active" {
+				if _, found := c.cache.CheckBundles[checkBundle.CID]; found {
+					delete(c.cache.CheckBundles, checkBundle.CID)
+					removed++
+				}
+				continue
+			}
+
+			cached := &cachedCheckBundle{CheckBundle: checkBundle}
+			if prev, found := previous[checkBundle.CID]; found && prev.CheckBundle.LastModified == checkBundle.LastModified {
+				cached.Metrics = prev.Metrics
+			}
+			c.cache.CheckBundles[checkBundle.CID] = cached
+			updated++
+		}
+	}
+
+	c.cache.LastSync = syncStart.Add(-cacheSyncSkew).Unix()
+	if full {
+		c.cache.LastFullSync = syncStart.Unix()
+	}
+	c.cacheSynced = true
+	c.refreshCache = false
+
+	c.log.Debug("synced check bundle cache", "full", full, "updated", updated, "removed", removed, "check_bundles", len(c.cache.CheckBundles))
+
+	return nil
+}
+
+// cachedCirconusTargets returns the targets of every active check bundle in
+// the cache.
+func (c *Reaper) cachedCirconusTargets(ctx context.Context) ([]string, error) {
+	if err := c.syncCache(ctx); err != nil {
+		return nil, err
+	}
+
+	hostMap := make(map[string]struct{}, len(c.cache.CheckBundles))
+	for _, cached := range c.cache.CheckBundles {
+		hostMap[cached.CheckBundle.Target] = struct{}{}
+	}
+
+	hosts := make([]string, 0, len(hostMap))
+	for host := range hostMap {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
+}
+
+// cachedCheckBundlesByTarget returns the cached active check bundles for
+// host.
+func (c *Reaper) cachedCheckBundlesByTarget(ctx context.Context, host string) ([]*circonusapi.CheckBundle, error) {
+	if err := c.syncCache(ctx); err != nil {
+		return nil, err
+	}
+
+	checkBundles := []*circonusapi.CheckBundle{}
+	for _, cached := range c.cache.CheckBundles {
+		target := cached.CheckBundle.Target
+		if target == host || (c.prefixSearch && strings.HasPrefix(target, host)) {
+			checkBundle := cached.CheckBundle
+			checkBundles = append(checkBundles, &checkBundle)
+		}
+	}
+	sort.Slice(checkBundles, func(i, j int) bool {
+		return checkBundles[i].CID < checkBundles[j].CID
+	})
+
+	return checkBundles, nil
+}
+
+// cachedCheckBundleMetrics returns the metrics of the check bundle from the
+// cache if they were fetched since the bundle last changed, otherwise fetches
+// and caches them.  syncCache drops the cached metrics of every bundle that
+// changed.  It returns nil metrics if a cached bundle no longer exists.
+func (c *Reaper) cachedCheckBundleMetrics(ctx context.Context, checkBundle *circonusapi.CheckBundle) (*circonusapi.CheckBundleMetrics, error) {
+	if c.cache == nil {
+		return c.fetchCheckBundleMetrics(ctx, checkBundle.CID)
+	}
+
+	cached, found := c.cache.CheckBundles[checkBundle.CID]
+	if found && cached.Metrics != nil {
+		c.log.Trace("using cached check bundle metrics", "check_bundle_cid", checkBundle.CID)
+		return copyCheckBundleMetrics(cached.Metrics), nil
+	}
+
+	cbm, err := c.fetchCheckBundleMetrics(ctx, checkBundle.CID)
+	if err != nil && found && isNotFound(err) {
+		// The bundle was deleted since the cache was synced.
+		c.log.Warn("check bundle is gone, evicting it from the cache", "check_bundle_cid", checkBundle.CID)
+		c.evictCachedCheckBundle(checkBundle.CID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		cached.Metrics = copyCheckBundleMetrics(cbm)
+	}
+
+	return cbm, nil
+}
+
+// invalidateCachedMetrics drops the cached metrics of a check bundle after
+// they were changed by the reaper.
+func (c *Reaper) invalidateCachedMetrics(checkBundleCID string) {
+	if c.cache == nil {
+		return
+	}
+
+	if cached, found := c.cache.CheckBundles[checkBundleCID]; found {
+		cached.Metrics = nil
+	}
+}
+
+// evictCachedCheckBundle drops a check bundle that no longer exists from the
+// cache.
+func (c *Reaper) evictCachedCheckBundle(checkBundleCID string) {
+	if c.cache == nil {
+		return
+	}
+
+	delete(c.cache.CheckBundles, checkBundleCID)
+}
+
+func copyCheckBundleMetrics(cbm *circonusapi.CheckBundleMetrics) *circonusapi.CheckBundleMetrics {
+	dup := &circonusapi.CheckBundleMetrics{
+		CID:     cbm.CID,
+		Metrics: make([]circonusapi.CheckBundleMetric, len(cbm.Metrics)),
+	}
+	copy(dup.Metrics, cbm.Metrics)
+
+	return dup
+}
@@ -0,0 +1,162 @@
+package reaper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncCache(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is made between the first and the second sync.
+		change      func(f *fakeCirconus, c *Reaper)
+		wantFull    bool
+		wantBundles []string
+		wantFetches int
+	}{
+		{
+			name:        "unchanged bundles keep their metrics",
+			change:      func(f *fakeCirconus, c *Reaper) {},
+			wantBundles: []string{"/check_bundle/1", "/check_bundle/2"},
+		},
+		{
+			name: "modified bundle refetches its metrics",
+			change: func(f *fakeCirconus, c *Reaper) {
+				f.touch("/check_bundle/1")
+			},
+			wantBundles: []string{"/check_bundle/1", "/check_bundle/2"},
+			wantFetches: 1,
+		},
+		{
+			name: "new bundle is added",
+			change: func(f *fakeCirconus, c *Reaper) {
+				f.addCheckBundle(3, "web3", "cpu")
+				f.touch("/check_bundle/3")
+			},
+			wantBundles: []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+			wantFetches: 1,
+		},
+		{
+			name: "deactivated bundle is removed",
+			change: func(f *fakeCirconus, c *Reaper) {
+				f.mu.Lock()
+				f.checkBundles["/check_bundle/2"].Status = "disabled"
+				f.mu.Unlock()
+				f.touch("/check_bundle/2")
+			},
+			wantBundles: []string{"/check_bundle/1"},
+		},
+		{
+			name: "deleted bundle is evicted when its metrics are fetched",
+			change: func(f *fakeCirconus, c *Reaper) {
+				f.mu.Lock()
+				delete(f.checkBundles, "/check_bundle/2")
+				delete(f.checkBundleMetrics, "/check_bundle/2")
+				f.mu.Unlock()
+				c.invalidateCachedMetrics("/check_bundle/2")
+			},
+			wantBundles: []string{"/check_bundle/1"},
+			wantFetches: 1,
+		},
+		{
+			name: "full sync after the interval keeps unchanged metrics",
+			change: func(f *fakeCirconus, c *Reaper) {
+				c.cache.LastFullSync = time.Now().Add(-cacheFullSyncInterval).Unix()
+				f.touch("/check_bundle/2")
+			},
+			wantFull:    true,
+			wantBundles: []string{"/check_bundle/1", "/check_bundle/2"},
+			wantFetches: 1,
+		},
+		{
+			name: "refresh refetches every bundle's metrics",
+			change: func(f *fakeCirconus, c *Reaper) {
+				c.refreshCache = true
+			},
+			wantFull:    true,
+			wantBundles: []string{"/check_bundle/1", "/check_bundle/2"},
+			wantFetches: 2,
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "reaper-cache")
+		if err != nil {
+			t.Fatalf("unable to create cache dir: %v", err)
+		}
+
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1", "cpu")
+		f.addCheckBundle(2, "web2", "cpu")
+		c := newTestReaper(t, f, Config{CacheDir: dir})
+		ctx := context.Background()
+
+		fetchMetrics := func() {
+			cids := make([]string, 0, len(c.cache.CheckBundles))
+			for cid := range c.cache.CheckBundles {
+				cids = append(cids, cid)
+			}
+			for _, cid := range cids {
+				cached, found := c.cache.CheckBundles[cid]
+				if !found {
+					continue
+				}
+				bundle := cached.CheckBundle
+				if _, err := c.cachedCheckBundleMetrics(ctx, &bundle); err != nil {
+					t.Errorf("%s: unable to get metrics of %s: %v", test.name, cid, err)
+				}
+			}
+		}
+
+		if err := c.syncCache(ctx); err != nil {
+			t.Fatalf("%s: first sync: %v", test.name, err)
+		}
+		fetchMetrics()
+
+		test.change(f, c)
+		c.cacheSynced = false
+		searches := f.countRequests("GET /check_bundle?")
+		fetches := f.countRequests("GET /check_bundle_metrics/")
+		if err := c.syncCache(ctx); err != nil {
+			t.Fatalf("%s: second sync: %v", test.name, err)
+		}
+		fetchMetrics()
+
+		if got := f.countRequests("GET /check_bundle?") - searches; got != 1 {
+			t.Errorf("%s: got %d searches, want 1", test.name, got)
+		}
+		f.mu.Lock()
+		lastSearch := ""
+		for _, req := range f.requests {
+			if strings.HasPrefix(req, "GET /check_bundle?") {
+				lastSearch = req
+			}
+		}
+		f.mu.Unlock()
+		if full := !strings.Contains(lastSearch, "f__last_modified_gt"); full != test.wantFull {
+			t.Errorf("%s: got full sync %t, want %t (%s)", test.name, full, test.wantFull, lastSearch)
+		}
+
+		var bundles []string
+		for cid := range c.cache.CheckBundles {
+			bundles = append(bundles, cid)
+		}
+		sort.Strings(bundles)
+		if !reflect.DeepEqual(bundles, test.wantBundles) {
+			t.Errorf("%s: got cached bundles %v, want %v", test.name, bundles, test.wantBundles)
+		}
+
+		if got := f.countRequests("GET /check_bundle_metrics/") - fetches; got != test.wantFetches {
+			t.Errorf("%s: got %d metric fetches, want %d", test.name, got, test.wantFetches)
+		}
+
+		f.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,404 @@
+package reaper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+)
+
+// fakeCirconus is an in-memory stand-in for the parts of the Circonus API the
+// reaper uses.  Searches understand just enough of the search syntax for the
+// tests: (active:1), (host:"target") and the filters the reaper sends.
+type fakeCirconus struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu                 sync.Mutex
+	checkBundles       map[string]*circonusapi.CheckBundle
+	checkBundleMetrics map[string]*circonusapi.CheckBundleMetrics
+	metrics            []circonusapi.Metric
+	ruleSets           map[string]*circonusapi.RuleSet
+	account            *circonusapi.Account
+	requests           []string
+
+	// fail maps "METHOD /path" to the status code to answer with instead.
+	fail map[string]int
+
+	// onRequest, if set, is called with "METHOD /path" before each request is
+	// served, without the lock held.
+	onRequest func(req string)
+}
+
+var fakeSearchHostRE = regexp.MustCompile(`\(host:"([^"]*)"\)`)
+
+func newFakeCirconus(t *testing.T) *fakeCirconus {
+	f := &fakeCirconus{
+		t:                  t,
+		checkBundles:       make(map[string]*circonusapi.CheckBundle),
+		checkBundleMetrics: make(map[string]*circonusapi.CheckBundleMetrics),
+		ruleSets:           make(map[string]*circonusapi.RuleSet),
+		fail:               make(map[string]int),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+
+	return f
+}
+
+// client returns a Circonus API client talking to the fake.
+func (f *fakeCirconus) client() *circonusapi.API {
+	api, err := circonusapi.New(&circonusapi.Config{
+		URL:      f.server.URL,
+		TokenKey: "test",
+		TokenApp: "reaper-test",
+	})
+	if err != nil {
+		f.t.Fatalf("unable to create Circonus API client: %v", err)
+	}
+
+	return api
+}
+
+func (f *fakeCirconus) Close() {
+	f.server.Close()
+}
+
+// addCheckBundle adds an active check bundle on target with the named
+// metrics, all active.
+func (f *fakeCirconus) addCheckBundle(id int, target string, metrics ...string) *circonusapi.CheckBundle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cid := fmt.Sprintf("/check_bundle/%d", id)
+	checkBundle := &circonusapi.CheckBundle{
+		CID:          cid,
+		Checks:       []string{fmt.Sprintf("/check/%d", id)},
+		Created:      uint(time.Now().Add(-30 * 24 * time.Hour).Unix()),
+		LastModified: uint(time.Now().Add(-24 * time.Hour).Unix()),
+		Status:       "active",
+		Target:       target,
+		Type:         "json",
+	}
+	cbm := &circonusapi.CheckBundleMetrics{CID: fmt.Sprintf("/check_bundle_metrics/%d", id)}
+	for _, name := range metrics {
+		metric := circonusapi.CheckBundleMetric{Name: name, Status: "active", Tags: []string{}, Type: "numeric"}
+		checkBundle.Metrics = append(checkBundle.Metrics, metric)
+		cbm.Metrics = append(cbm.Metrics, metric)
+	}
+	f.checkBundles[cid] = checkBundle
+	f.checkBundleMetrics[cid] = cbm
+
+	return checkBundle
+}
+
+// checkBundle returns a copy of the check bundle, or nil if it doesn't exist.
+func (f *fakeCirconus) checkBundle(cid string) *circonusapi.CheckBundle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkBundle, found := f.checkBundles[cid]
+	if !found {
+		return nil
+	}
+	dup := *checkBundle
+
+	return &dup
+}
+
+// metricStatuses returns the status of every metric of the check bundle by
+// name.
+func (f *fakeCirconus) metricStatuses(cid string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	statuses := make(map[string]string)
+	if cbm, found := f.checkBundleMetrics[cid]; found {
+		for _, metric := range cbm.Metrics {
+			statuses[metric.Name] = metric.Status
+		}
+	}
+
+	return statuses
+}
+
+// touch marks the check bundle as modified now, as a change made outside the
+// reaper would.
+func (f *fakeCirconus) touch(cid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.checkBundles[cid].LastModified = f.nextModified(f.checkBundles[cid].LastModified)
+}
+
+// nextModified returns a _last_modified that is later than last.
+func (f *fakeCirconus) nextModified(last uint) uint {
+	now := uint(time.Now().Unix())
+	if now <= last {
+		now = last + 1
+	}
+
+	return now
+}
+
+// countRequests returns how many of the requests served start with prefix,
+// e.g. "PUT /check_bundle/".
+func (f *fakeCirconus) countRequests(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int
+	for _, req := range f.requests {
+		if strings.HasPrefix(req, prefix) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (f *fakeCirconus) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	req := r.Method + " " + r.URL.Path
+	if f.onRequest != nil {
+		f.onRequest(req)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, req+"?"+r.URL.RawQuery)
+	if code, found := f.fail[req]; found {
+		http.Error(w, `{"code":"fake","message":"injected failure"}`, code)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	id := ""
+	if len(parts) == 2 {
+		id = "/" + parts[0] + "/" + parts[1]
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/check_bundle":
+		f.reply(w, f.searchCheckBundles(q))
+	case parts[0] == "check_bundle" && id != "":
+		checkBundle, found := f.checkBundles[id]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			f.reply(w, checkBundle)
+		case "PUT":
+			var updated circonusapi.CheckBundle
+			if !f.decode(w, body, &updated) {
+				return
+			}
+			updated.LastModified = f.nextModified(checkBundle.LastModified)
+			f.checkBundles[id] = &updated
+			f.reply(w, &updated)
+		case "DELETE":
+			delete(f.checkBundles, id)
+			delete(f.checkBundleMetrics, id)
+			f.reply(w, nil)
+		}
+	case parts[0] == "check_bundle_metrics" && id != "":
+		bundleCID := "/check_bundle/" + parts[1]
+		cbm, found := f.checkBundleMetrics[bundleCID]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			f.reply(w, cbm)
+		case "PUT":
+			var updated circonusapi.CheckBundleMetrics
+			if !f.decode(w, body, &updated) {
+				return
+			}
+			f.checkBundleMetrics[bundleCID] = &updated
+			checkBundle := f.checkBundles[bundleCID]
+			checkBundle.Metrics = updated.Metrics
+			checkBundle.LastModified = f.nextModified(checkBundle.LastModified)
+			f.reply(w, &updated)
+		}
+	case r.Method == "GET" && r.URL.Path == "/metric":
+		f.reply(w, f.searchMetrics(q))
+	case r.Method == "GET" && parts[0] == "data":
+		f.reply(w, map[string]interface{}{"data": [][]interface{}{}})
+	case r.Method == "GET" && r.URL.Path == "/rule_set":
+		ruleSets := []circonusapi.RuleSet{}
+		for _, cid := range f.sortedRuleSetCIDs() {
+			ruleSet := f.ruleSets[cid]
+			if check := q.Get("f_check"); check != "" && ruleSet.CheckCID != check {
+				continue
+			}
+			ruleSets = append(ruleSets, *ruleSet)
+		}
+		f.reply(w, ruleSets)
+	case parts[0] == "rule_set" && id != "":
+		ruleSet, found := f.ruleSets[id]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			f.reply(w, ruleSet)
+		case "PUT":
+			var updated circonusapi.RuleSet
+			if !f.decode(w, body, &updated) {
+				return
+			}
+			f.ruleSets[id] = &updated
+			f.reply(w, &updated)
+		case "DELETE":
+			delete(f.ruleSets, id)
+			f.reply(w, nil)
+		}
+	case r.Method == "POST" && (r.URL.Path == "/maintenance" || r.URL.Path == "/annotation"):
+		var created map[string]interface{}
+		if !f.decode(w, body, &created) {
+			return
+		}
+		created["_cid"] = fmt.Sprintf("%s/%d", r.URL.Path, len(f.requests))
+		f.reply(w, created)
+	case r.Method == "DELETE" && parts[0] == "maintenance":
+		f.reply(w, nil)
+	case r.Method == "GET" && r.URL.Path == "/account/current" && f.account != nil:
+		f.reply(w, f.account)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeCirconus) searchCheckBundles(q map[string][]string) []circonusapi.CheckBundle {
+	search := strings.Join(q["search"], " ")
+	cids := make([]string, 0, len(f.checkBundles))
+	for cid := range f.checkBundles {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+
+	checkBundles := []circonusapi.CheckBundle{}
+	for _, cid := range cids {
+		checkBundle := f.checkBundles[cid]
+		if strings.Contains(search, "(active:1)") && checkBundle.Status != "active" {
+			continue
+		}
+		if md := fakeSearchHostRE.FindStringSubmatch(search); md != nil {
+			if prefix := strings.TrimSuffix(md[1], "*"); prefix != md[1] {
+				if !strings.HasPrefix(checkBundle.Target, prefix) {
+					continue
+				}
+			} else if checkBundle.Target != md[1] {
+				continue
+			}
+		}
+		if v, found := q["f__last_modified_gt"]; found {
+			since, _ := strconv.ParseUint(v[0], 10, 64)
+			if uint64(checkBundle.LastModified) <= since {
+				continue
+			}
+		}
+		if v, found := q["f_tags_has"]; found && !containsString(checkBundle.Tags, v[0]) {
+			continue
+		}
+		checkBundles = append(checkBundles, *checkBundle)
+	}
+
+	return checkBundles
+}
+
+// fakeDefaultPageSize is how many results the fake returns from a search
+// without a size.
+const fakeDefaultPageSize = 100
+
+func (f *fakeCirconus) searchMetrics(q map[string][]string) []circonusapi.Metric {
+	search := strings.Join(q["search"], " ")
+
+	var metrics []circonusapi.Metric
+	for _, metric := range f.metrics {
+		if strings.Contains(search, "(active:1)") && !metric.Active {
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	size, offset := fakeDefaultPageSize, 0
+	if v, found := q["size"]; found {
+		size, _ = strconv.Atoi(v[0])
+	}
+	if v, found := q["offset"]; found {
+		offset, _ = strconv.Atoi(v[0])
+	}
+
+	page := []circonusapi.Metric{}
+	for i := offset; i < len(metrics) && i < offset+size; i++ {
+		page = append(page, metrics[i])
+	}
+
+	return page
+}
+
+func (f *fakeCirconus) sortedRuleSetCIDs() []string {
+	cids := make([]string, 0, len(f.ruleSets))
+	for cid := range f.ruleSets {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+
+	return cids
+}
+
+func (f *fakeCirconus) decode(w http.ResponseWriter, body []byte, v interface{}) bool {
+	if err := json.Unmarshal(body, v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (f *fakeCirconus) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if v == nil {
+		w.Write([]byte("{}"))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Errorf("unable to encode response: %v", err)
+	}
+}
+
+// newTestReaper returns a reaper talking to the fake, configured by cfg, that
+// is ready for its methods to be called outside of a run.
+func newTestReaper(t *testing.T, f *fakeCirconus, cfg Config) *Reaper {
+	cfg.CirconusClient = f.client()
+	c, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("unable to create reaper: %v", err)
+	}
+	c.updateCtx = context.Background()
+
+	return c
+}
@@ -0,0 +1,193 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+)
+
+// Policies for metric clusters whose queries match no active metrics.
+const (
+	ClusterPolicyReport = "report"
+	ClusterPolicyDelete = "delete"
+)
+
+// reaperState is the state persisted between runs.
+type reaperState struct {
+	// EmptyMetricClusters counts the consecutive runs in which a metric
+	// cluster's queries matched no active metrics.
+	EmptyMetricClusters map[string]uint `json:"empty_metric_clusters"`
+}
+
+func (c *Reaper) loadState() (*reaperState, error) {
+	state := &reaperState{
+		EmptyMetricClusters: make(map[string]uint),
+	}
+
+	if c.state == nil {
+		return state, nil
+	}
+
+	if err := c.state.Load(state); err != nil {
+		return nil, err
+	}
+
+	if state.EmptyMetricClusters == nil {
+		state.EmptyMetricClusters = make(map[string]uint)
+	}
+
+	return state, nil
+}
+
+// reapMetricClusters evaluates every metric cluster's queries against the
+// active metrics and flags (or deletes, per policy) clusters that matched
+// nothing for the configured number of consecutive runs.  State is not saved
+// during a dry run.
+func (c *Reaper) reapMetricClusters(ctx context.Context) error {
+	state, err := c.loadState()
+	if err != nil {
+		return errwrap.Wrapf("unable to load state: {{err}}", err)
+	}
+
+	var clusters *[]circonusapi.MetricCluster
+	start := time.Now()
+	err = c.apiCall(ctx, func() (err error) {
+		clusters, err = c.circonusClient.FetchMetricClusters("")
+		return err
+	})
+	c.observeAPICall("FetchMetricClusters", start, err)
+	c.report.addAPICall("FetchMetricClusters", config.MetricClusterPrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to fetch metric clusters: {{err}}", err)
+	}
+
+	emptyMetricClusters := make(map[string]uint)
+	if clusters != nil {
+		for i := range *clusters {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			cluster := &(*clusters)[i]
+
+			matched, err := c.metricClusterMatchesActive(ctx, cluster)
+			if err != nil {
+				// Carry the previous count forward so a failed lookup neither
+				// resets nor advances the cluster towards deletion.
+				c.log.Error("unable to evaluate metric cluster", "metric_cluster_cid", cluster.CID, "error", err)
+				c.recordFailure(failureKindMetricCluster, cluster.CID, err)
+				if n, found := state.EmptyMetricClusters[cluster.CID]; found {
+					emptyMetricClusters[cluster.CID] = n
+				}
+				continue
+			}
+
+			if matched {
+				c.log.Trace("metric cluster matches active metrics", "metric_cluster_cid", cluster.CID)
+				continue
+			}
+
+			emptyRuns := state.EmptyMetricClusters[cluster.CID] + 1
+			emptyMetricClusters[cluster.CID] = emptyRuns
+
+			if emptyRuns < c.clusterEmptyRuns {
+				c.log.Info("metric cluster matches no active metrics", "metric_cluster_cid", cluster.CID, "name", cluster.Name, "empty_runs", emptyRuns)
+				c.report.addMetricCluster(cluster.CID, cluster.Name, emptyRuns, decisionSkip)
+				continue
+			}
+
+			c.stats.EmptyMetricClusters++
+			if err := c.applyClusterPolicy(ctx, cluster, emptyRuns); err != nil {
+				c.log.Error("unable to reap metric cluster", "metric_cluster_cid", cluster.CID, "action", c.clusterPolicy, "error", err)
+				c.recordFailure(failureKindMetricCluster, cluster.CID, err)
+				continue
+			}
+
+			if c.clusterPolicy == ClusterPolicyDelete && !c.dryRun {
+				delete(emptyMetricClusters, cluster.CID)
+			}
+		}
+	}
+
+	if c.dryRun {
+		return nil
+	}
+
+	state.EmptyMetricClusters = emptyMetricClusters
+	if c.state != nil {
+		if err := c.state.Save(state); err != nil {
+			return errwrap.Wrapf("unable to save state: {{err}}", err)
+		}
+	}
+
+	return nil
+}
+
+// metricClusterMatchesActive returns true if any of the cluster's queries
+// match at least one active metric.
+func (c *Reaper) metricClusterMatchesActive(ctx context.Context, cluster *circonusapi.MetricCluster) (bool, error) {
+	for _, query := range cluster.Queries {
+		searchQuery := circonusapi.SearchQueryType(fmt.Sprintf("%s (active:1)", query.Query))
+		filter := circonusapi.SearchFilterType{
+			"size": []string{"1"},
+		}
+
+		var metrics *[]circonusapi.Metric
+		start := time.Now()
+		err := c.apiCall(ctx, func() (err error) {
+			metrics, err = c.circonusClient.SearchMetrics(&searchQuery, &filter)
+			return err
+		})
+		c.observeAPICall("SearchMetrics", start, err)
+		c.report.addAPICall("SearchMetrics", cluster.CID, false, err)
+		if err != nil {
+			return false, errwrap.Wrapf(fmt.Sprintf("unable to search for metrics matching %q: {{err}}", query.Query), err)
+		}
+
+		if metrics != nil && len(*metrics) > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (c *Reaper) applyClusterPolicy(ctx context.Context, cluster *circonusapi.MetricCluster, emptyRuns uint) error {
+	log := c.log.With("metric_cluster_cid", cluster.CID, "name", cluster.Name, "empty_runs", emptyRuns, "action", c.clusterPolicy)
+	c.report.addMetricCluster(cluster.CID, cluster.Name, emptyRuns, c.clusterPolicy)
+
+	if c.clusterPolicy == ClusterPolicyReport {
+		log.Info("found metric cluster matching no active metrics")
+		return nil
+	}
+
+	if c.dryRun {
+		log.Info("dry-run: about to delete metric cluster matching no active metrics")
+		c.report.addAPICall("DeleteMetricCluster", cluster.CID, true, nil)
+		return nil
+	}
+
+	ctx, err := c.beginUpdate(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := c.journal.Record(c.runID, ClusterPolicyDelete, "metric_cluster", cluster.CID, cluster); err != nil {
+		return errwrap.Wrapf("unable to journal metric cluster: {{err}}", err)
+	}
+
+	log.Info("deleting metric cluster matching no active metrics")
+	start := time.Now()
+	err = c.updateCall(ctx, func() error {
+		_, err := c.circonusClient.DeleteMetricCluster(cluster)
+		return err
+	})
+	c.observeAPICall("DeleteMetricCluster", start, err)
+	c.report.addAPICall("DeleteMetricCluster", cluster.CID, false, err)
+
+	return err
+}
@@ -0,0 +1,374 @@
+package reaper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/armon/go-metrics"
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/hashicorp/errwrap"
+)
+
+// Modes a Reaper operates in.
+const (
+	ModeAudit    = "audit"
+	ModeBrokers  = "brokers"
+	ModeBudget   = "budget"
+	ModeClusters = "clusters"
+	ModeQuery    = "query"
+	ModeStale    = "stale"
+
+	// ModeHosts reaps the check bundles of hosts that left the host
+	// inventory.
+	ModeHosts = "hosts"
+
+	// ModeAllocs reaps the metrics of allocs that left the alloc inventory.
+	ModeAllocs = "allocs"
+
+	// ModeConsulNomad does the work of both ModeHosts and ModeAllocs in a
+	// single run.
+	ModeConsulNomad = "consul/nomad"
+)
+
+// Config configures a Reaper.  Fields left at their zero value get the same
+// defaults as the circonus-reaper command line, except that durations other
+// than StaleAfter and booleans default to off.
+type Config struct {
+	// Mode is what Run reaps.  A reaper without a mode can only reap or
+	// restore the targets passed to ReapTargets or RestoreTargets.
+	Mode string
+
+	// CirconusClient is the Circonus API client to reap with.  Required.
+	CirconusClient *circonusapi.API
+
+	// Hosts is the inventory of live hosts.  Required in ModeHosts and
+	// ModeConsulNomad.  In ModeAllocs it limits the Nomad clients whose
+	// allocs are reaped to those in the inventory.
+	Hosts HostInventory
+
+	// Allocs is the inventory of Nomad allocs.  Required in ModeAllocs,
+	// ModeConsulNomad and with the nomad budget rule.
+	Allocs AllocInventory
+
+	// State keeps state between runs.  Required in ModeClusters.
+	State StateStore
+
+	// Logger receives the reaper's log events.  Nothing is logged if nil.
+	Logger *Logger
+
+	// GitCommit is recorded in the report of every run.
+	GitCommit string
+
+	DryRun          bool
+	ExcludeRegexps  []*regexp.Regexp
+	ExcludeTargets  []string
+	PrefixSearch    bool
+	ReactivateHosts bool
+
+	// DeactivateHosts deactivates the check bundles of Circonus targets
+	// missing from the host inventory in ModeHosts and ModeConsulNomad.  Off
+	// by default, when they are only reported, because it covers every
+	// Circonus target, including those the inventory never knew about.
+	DeactivateHosts bool
+
+	// TargetAction is what ReapTargets does with the check bundles of its
+	// targets.
+	TargetAction string
+
+	// CacheDir is the directory to cache check bundles in between runs.
+	// Check bundles aren't cached if empty.
+	CacheDir     string
+	RefreshCache bool
+
+	// JournalFile is the file the full JSON of every object is appended to
+	// before it is modified or deleted.  Nothing is journaled if empty.
+	JournalFile string
+
+	// MetricsTrapURL is the Circonus HTTPTrap submission URL the reaper's own
+	// metrics are submitted to after every run.
+	MetricsTrapURL string
+
+	// MetricsSink receives the reaper's own metrics as they are emitted.
+	// They are discarded if neither it nor MetricsTrapURL is set.
+	MetricsSink metrics.MetricSink
+
+	Annotate           bool
+	AnnotatePerTarget  bool
+	AnnotationCategory string
+
+	RuleSetPolicy     string
+	MaintenanceScope  string
+	MaintenanceWindow time.Duration
+
+	MetricQueries []string
+	QueryAction   string
+	QueryTag      string
+	QueryUnits    string
+
+	AuditRemoveDatapoints bool
+
+	ClusterEmptyRuns uint
+	ClusterPolicy    string
+
+	BrokerPolicy      string
+	ReplacementBroker string
+
+	// StaleAfter is how long an active metric may go without data before it
+	// is stale.  Defaults to 7 days.
+	StaleAfter time.Duration
+
+	// StaleMaxMetrics bounds the number of metrics whose data is fetched per
+	// run to find stale metrics.  Metrics are checked in random order so that
+	// every metric is eventually checked.
+	StaleMaxMetrics uint
+
+	UnknownStatusPolicy string
+	NomadDefaultPolicy  NomadJobPolicy
+
+	MetricBudget    uint
+	BudgetUsageType string
+	BudgetRules     []string
+	BudgetTags      []string
+
+	// RequestTimeout bounds every Circonus, Consul or Nomad request other
+	// than Circonus updates, which are never abandoned, and RunTimeout bounds
+	// every run.  Neither is bounded if zero.
+	RequestTimeout time.Duration
+	RunTimeout     time.Duration
+}
+
+// New returns a Reaper configured by cfg.
+func New(cfg *Config) (*Reaper, error) {
+	c := &Reaper{
+		mode:                  cfg.Mode,
+		circonusClient:        cfg.CirconusClient,
+		hosts:                 cfg.Hosts,
+		allocs:                cfg.Allocs,
+		state:                 cfg.State,
+		logger:                cfg.Logger,
+		gitCommit:             cfg.GitCommit,
+		dryRun:                cfg.DryRun,
+		excludeRegexps:        cfg.ExcludeRegexps,
+		prefixSearch:          cfg.PrefixSearch,
+		deactivateHosts:       cfg.DeactivateHosts,
+		reactivateHosts:       cfg.ReactivateHosts,
+		targetAction:          stringOrDefault(cfg.TargetAction, TargetActionDeactivate),
+		refreshCache:          cfg.RefreshCache,
+		metricsTrapURL:        cfg.MetricsTrapURL,
+		apiErrors:             newLabeledCounter(),
+		annotate:              cfg.Annotate,
+		annotatePerTarget:     cfg.AnnotatePerTarget,
+		annotationCategory:    stringOrDefault(cfg.AnnotationCategory, "reaper"),
+		ruleSetPolicy:         stringOrDefault(cfg.RuleSetPolicy, RuleSetPolicyNone),
+		maintenanceScope:      stringOrDefault(cfg.MaintenanceScope, MaintenanceScopeCheck),
+		maintenanceWindow:     cfg.MaintenanceWindow,
+		metricQueries:         cfg.MetricQueries,
+		queryAction:           stringOrDefault(cfg.QueryAction, QueryActionDeactivate),
+		queryTag:              cfg.QueryTag,
+		queryUnits:            cfg.QueryUnits,
+		auditRemoveDatapoints: cfg.AuditRemoveDatapoints,
+		clusterEmptyRuns:      cfg.ClusterEmptyRuns,
+		clusterPolicy:         stringOrDefault(cfg.ClusterPolicy, ClusterPolicyReport),
+		brokerPolicy:          stringOrDefault(cfg.BrokerPolicy, BrokerPolicyReport),
+		replacementBroker:     cfg.ReplacementBroker,
+		staleAfter:            cfg.StaleAfter,
+		staleMaxMetrics:       cfg.StaleMaxMetrics,
+		unknownStatusPolicy:   stringOrDefault(cfg.UnknownStatusPolicy, UnknownStatusPolicyReport),
+		nomadDefaultPolicy:    cfg.NomadDefaultPolicy,
+		metricBudget:          cfg.MetricBudget,
+		budgetUsageType:       stringOrDefault(cfg.BudgetUsageType, "Metric"),
+		budgetRules:           cfg.BudgetRules,
+		budgetTags:            cfg.BudgetTags,
+		requestTimeout:        cfg.RequestTimeout,
+		runTimeout:            cfg.RunTimeout,
+	}
+
+	if c.logger == nil {
+		c.logger = NewLogger(ioutil.Discard, LevelError, LogFormatText)
+	}
+	if c.clusterEmptyRuns == 0 {
+		c.clusterEmptyRuns = 3
+	}
+	if c.staleAfter == 0 {
+		c.staleAfter = 7 * 24 * time.Hour
+	}
+	if c.staleMaxMetrics == 0 {
+		c.staleMaxMetrics = 5000
+	}
+	if c.budgetRules == nil {
+		c.budgetRules = []string{BudgetRuleStale, BudgetRuleNomad, BudgetRuleTags}
+	}
+
+	c.delayedAllocNodes = make(map[string]time.Time)
+
+	c.excludeTargets = make(map[string]bool, len(cfg.ExcludeTargets))
+	for _, v := range cfg.ExcludeTargets {
+		c.excludeTargets[v] = true
+	}
+
+	journal, err := newJournal(cfg.JournalFile)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to setup journal: {{err}}", err)
+	}
+	c.journal = journal
+
+	cache, err := newBundleCache(cfg.CacheDir)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to setup check bundle cache: {{err}}", err)
+	}
+	c.cache = cache
+
+	m, metricsSink, err := setupMetrics(cfg.MetricsTrapURL, cfg.MetricsSink)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to setup reaper metrics: {{err}}", err)
+	}
+	c.metrics = m
+	c.metricsSink = metricsSink
+
+	if err := c.validate(); err != nil {
+		return nil, errwrap.Wrapf("reaper config does not validate: {{err}}", err)
+	}
+
+	c.reset(c.mode)
+
+	return c, nil
+}
+
+func (c *Reaper) validate() error {
+	if c.circonusClient == nil {
+		return fmt.Errorf("Circonus client can not be nil")
+	}
+
+	switch c.targetAction {
+	case TargetActionDeactivate:
+	case TargetActionDelete:
+		if c.journal == nil {
+			return fmt.Errorf("journal file is required with target action %q", c.targetAction)
+		}
+	default:
+		return fmt.Errorf("unknown target action: %q", c.targetAction)
+	}
+
+	switch c.ruleSetPolicy {
+	case RuleSetPolicyNone, RuleSetPolicyReport:
+	case RuleSetPolicyDisable, RuleSetPolicyDelete:
+		if c.journal == nil {
+			return fmt.Errorf("journal file is required with rule set policy %q", c.ruleSetPolicy)
+		}
+	default:
+		return fmt.Errorf("unknown rule set policy: %q", c.ruleSetPolicy)
+	}
+
+	switch c.unknownStatusPolicy {
+	case UnknownStatusPolicySkip, UnknownStatusPolicyReport, UnknownStatusPolicyActive:
+	default:
+		return fmt.Errorf("invalid unknown status policy: %q", c.unknownStatusPolicy)
+	}
+
+	switch c.maintenanceScope {
+	case MaintenanceScopeCheck, MaintenanceScopeHost:
+	default:
+		return fmt.Errorf("unknown maintenance scope: %q", c.maintenanceScope)
+	}
+
+	if c.auditRemoveDatapoints && c.journal == nil {
+		return fmt.Errorf("journal file is required to remove audited datapoints")
+	}
+
+	switch c.mode {
+	case "", ModeAudit:
+	case ModeBrokers:
+		switch c.brokerPolicy {
+		case BrokerPolicyReport:
+		case BrokerPolicyReassign, BrokerPolicyDeactivate:
+			if c.journal == nil {
+				return fmt.Errorf("journal file is required with broker policy %q", c.brokerPolicy)
+			}
+		default:
+			return fmt.Errorf("unknown broker policy: %q", c.brokerPolicy)
+		}
+		if c.brokerPolicy == BrokerPolicyReassign && c.replacementBroker == "" {
+			return fmt.Errorf("replacement broker is required with broker policy %q", c.brokerPolicy)
+		}
+	case ModeQuery:
+		if len(c.metricQueries) == 0 {
+			return fmt.Errorf("at least one metric query is required in %s mode", c.mode)
+		}
+		switch c.queryAction {
+		case QueryActionDeactivate, QueryActionActivate:
+		case QueryActionAddTag, QueryActionRemoveTag:
+			if c.queryTag == "" {
+				return fmt.Errorf("query tag is required with query action %q", c.queryAction)
+			}
+		case QueryActionSetUnits:
+			if c.queryUnits == "" {
+				return fmt.Errorf("query units are required with query action %q", c.queryAction)
+			}
+		default:
+			return fmt.Errorf("unknown query action: %q", c.queryAction)
+		}
+	case ModeStale:
+		if c.staleAfter < time.Hour {
+			return fmt.Errorf("stale after must be at least 1h")
+		}
+	case ModeBudget:
+		for _, rule := range c.budgetRules {
+			switch rule {
+			case BudgetRuleStale, BudgetRuleNomad, BudgetRuleTags:
+			default:
+				return fmt.Errorf("unknown budget rule: %q", rule)
+			}
+		}
+		if containsString(c.budgetRules, BudgetRuleStale) && c.staleAfter < time.Hour {
+			return fmt.Errorf("stale after must be at least 1h with budget rule %q", BudgetRuleStale)
+		}
+		if containsString(c.budgetRules, BudgetRuleNomad) && c.allocs == nil {
+			return fmt.Errorf("Nomad alloc inventory can not be nil with budget rule %q", BudgetRuleNomad)
+		}
+		if containsString(c.budgetRules, BudgetRuleTags) && len(c.budgetTags) == 0 {
+			return fmt.Errorf("budget tags are required with budget rule %q", BudgetRuleTags)
+		}
+	case ModeClusters:
+		if c.state == nil {
+			return fmt.Errorf("state store can not be nil in %s mode", c.mode)
+		}
+		switch c.clusterPolicy {
+		case ClusterPolicyReport:
+		case ClusterPolicyDelete:
+			if c.journal == nil {
+				return fmt.Errorf("journal file is required with cluster policy %q", c.clusterPolicy)
+			}
+		default:
+			return fmt.Errorf("unknown cluster policy: %q", c.clusterPolicy)
+		}
+	case ModeHosts:
+		if c.hosts == nil {
+			return fmt.Errorf("host inventory can not be nil in %s mode", c.mode)
+		}
+	case ModeAllocs:
+		if c.allocs == nil {
+			return fmt.Errorf("Nomad alloc inventory can not be nil in %s mode", c.mode)
+		}
+	case ModeConsulNomad:
+		if c.hosts == nil {
+			return fmt.Errorf("host inventory can not be nil")
+		}
+		if c.allocs == nil {
+			return fmt.Errorf("Nomad alloc inventory can not be nil")
+		}
+	default:
+		return fmt.Errorf("unsupported mode: %q", c.mode)
+	}
+
+	return nil
+}
+
+func stringOrDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+
+	return s
+}
@@ -0,0 +1,89 @@
+package reaper
+
+import (
+	"context"
+	"time"
+)
+
+// apiCall runs call, a single request to Circonus, Consul or Nomad, bounded by
+// ctx and the per-request timeout.  The vendored API clients don't accept a
+// context, so a call that outlives its deadline is abandoned: ctx's error is
+// returned and the call's results must not be used.  Requests that change
+// Circonus go through updateCall instead.
+func (c *Reaper) apiCall(ctx context.Context, call func() error) error {
+	return callWithTimeout(ctx, c.requestTimeout, call)
+}
+
+// updateCall runs call, a single request that changes Circonus, unless ctx is
+// already done.  Once started, call is waited for however long it takes:
+// the Circonus client can't cancel a request, so an abandoned update could
+// still be applied and its outcome would be unknown.
+func (c *Reaper) updateCall(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return call()
+}
+
+// callWithTimeout runs call bounded by ctx and, if it is positive, timeout.
+func callWithTimeout(ctx context.Context, timeout time.Duration, call func() error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- call()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HTTPClientTimeout returns the timeout to give the HTTP clients of Consul and
+// Nomad so that a request abandoned by apiCall doesn't carry on in the
+// background.  The clients of a watching reaper also serve blocking queries
+// and get their longer timeout.  It returns 0, no timeout, if requestTimeout
+// is 0.
+func HTTPClientTimeout(requestTimeout time.Duration, watch bool) time.Duration {
+	switch {
+	case requestTimeout <= 0:
+		return 0
+	case watch:
+		return blockingCallTimeout(requestTimeout)
+	default:
+		return requestTimeout
+	}
+}
+
+// blockingCallTimeout returns how long a blocking query may take: the wait
+// time, plus the jitter Consul and Nomad add to it, on top of the per-request
+// timeout.
+func blockingCallTimeout(requestTimeout time.Duration) time.Duration {
+	return watchWaitTime + watchWaitTime/16 + requestTimeout
+}
+
+// beginUpdate returns ctx's error if the run has been cancelled or has run
+// out of time.  Otherwise it returns the context to carry out an update in:
+// one that is bounded by the run timeout but not cancelled with the run, so
+// that an update that has started is completed, maintenance windows and all,
+// if the reaper is interrupted part way through.  Once the run timeout has
+// passed no further request of the update is started.
+func (c *Reaper) beginUpdate(ctx context.Context) (context.Context, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return c.updateCtx, nil
+}
@@ -0,0 +1,64 @@
+package reaper
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		slow       string
+		call       func(c *Reaper, cid string) error
+		wantErr    bool
+		wantStatus string
+	}{
+		{
+			name: "slow read is abandoned",
+			slow: "GET /check_bundle/1",
+			call: func(c *Reaper, cid string) error {
+				_, err := c.fetchCheckBundle(context.Background(), cid)
+				return err
+			},
+			wantErr:    true,
+			wantStatus: "active",
+		},
+		{
+			name: "slow update is waited for",
+			slow: "PUT /check_bundle/1",
+			call: func(c *Reaper, cid string) error {
+				checkBundle, err := c.fetchCheckBundle(context.Background(), cid)
+				if err != nil {
+					return err
+				}
+				return c.deactivateCheckBundle(c.updateCtx, checkBundle)
+			},
+			wantStatus: "disabled",
+		},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1", "cpu")
+		slow := test.slow
+		f.onRequest = func(req string) {
+			if strings.HasPrefix(req, slow) {
+				time.Sleep(200 * time.Millisecond)
+			}
+		}
+
+		c := newTestReaper(t, f, Config{RequestTimeout: 20 * time.Millisecond})
+		err := test.call(c, "/check_bundle/1")
+		if timedOut := err != nil && strings.Contains(err.Error(), context.DeadlineExceeded.Error()); timedOut != test.wantErr || (err != nil && !timedOut) {
+			t.Errorf("%s: error %v, want timed out %v", test.name, err, test.wantErr)
+		}
+
+		if status := f.checkBundle("/check_bundle/1").Status; status != test.wantStatus {
+			t.Errorf("%s: check bundle status %q, want %q", test.name, status, test.wantStatus)
+		}
+
+		f.Close()
+	}
+}
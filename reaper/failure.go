@@ -0,0 +1,55 @@
+package reaper
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/ryanuber/columnize"
+)
+
+// Kinds of objects a failure is recorded against.
+const (
+	failureKindAlloc         = "alloc"
+	failureKindCheck         = "check"
+	failureKindCheckBundle   = "check_bundle"
+	failureKindDashboard     = "dashboard"
+	failureKindGraph         = "graph"
+	failureKindMetric        = "metric"
+	failureKindMetricCluster = "metric_cluster"
+	failureKindQuery         = "query"
+	failureKindRuleSet       = "rule_set"
+	failureKindTarget        = "target"
+)
+
+// recordFailure notes an error that was handled softly so the run could carry
+// on with the remaining targets.  The error is attached to the object it
+// belongs to in the run report.
+func (c *Reaper) recordFailure(kind, id string, err error) {
+	c.failures = multierror.Append(c.failures, errwrap.Wrapf(fmt.Sprintf("%s %q: {{err}}", kind, id), err))
+	c.report.addFailure(kind, id, err)
+}
+
+// numFailures returns the number of soft errors recorded during this run.
+func (c *Reaper) numFailures() int {
+	if c.failures == nil {
+		return 0
+	}
+
+	return len(c.failures.Errors)
+}
+
+// printFailures writes the objects that could not be processed and why.
+func (r *Report) printFailures(w io.Writer) {
+	if len(r.Failures) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "Failures:")
+	output := []string{"Kind | ID | Error"}
+	for _, f := range r.Failures {
+		output = append(output, fmt.Sprintf("%s | %s | %s", f.Kind, f.ID, f.Error))
+	}
+	fmt.Fprintln(w, columnize.SimpleFormat(output))
+}
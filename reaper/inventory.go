@@ -0,0 +1,176 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/errwrap"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// ErrNotFound is returned by an AllocInventory when the job or alloc asked for
+// doesn't exist, e.g. because it was garbage collected.
+var ErrNotFound = errors.New("not found")
+
+// HostInventory lists the hosts that are still in service.  The check bundles
+// of targets that aren't in the inventory are reaped.
+//
+// Calls are bounded by the reaper's request timeout: an implementation that
+// can't honor ctx may be abandoned once it expires.
+type HostInventory interface {
+	// Hosts returns the name of every host in the inventory.
+	Hosts(ctx context.Context) ([]string, error)
+}
+
+// AllocInventory describes the Nomad clients and the allocs placed on them.
+// The metrics of allocs that are no longer placed on their client are reaped.
+//
+// Calls are bounded by the reaper's request timeout: an implementation that
+// can't honor ctx may be abandoned once it expires.
+type AllocInventory interface {
+	// Nodes returns the ID of every client, keyed by node name.
+	Nodes(ctx context.Context) (map[string]string, error)
+
+	// NodeAllocs returns the allocs placed on a client, keyed by alloc ID.
+	NodeAllocs(ctx context.Context, nodeID string) (map[string]*nomadapi.Allocation, error)
+
+	// LiveAllocs returns the IDs of every pending or running alloc.
+	LiveAllocs(ctx context.Context) ([]string, error)
+
+	// JobMeta returns the meta of a job, or ErrNotFound if the job is gone.
+	JobMeta(ctx context.Context, jobID string) (map[string]string, error)
+
+	// Alloc returns an alloc, including its task states, or ErrNotFound if
+	// the alloc is gone.
+	Alloc(ctx context.Context, allocID string) (*nomadapi.Allocation, error)
+}
+
+// ConsulInventory is a HostInventory of the nodes in the Consul catalog.
+type ConsulInventory struct {
+	client *consulapi.Client
+}
+
+// NewConsulInventory returns a HostInventory backed by the Consul catalog.
+func NewConsulInventory(client *consulapi.Client) *ConsulInventory {
+	return &ConsulInventory{client: client}
+}
+
+func (i *ConsulInventory) Hosts(ctx context.Context) ([]string, error) {
+	queryOpts := &consulapi.QueryOptions{
+		AllowStale: true,
+	}
+	nodes, _, err := i.client.Catalog().Nodes(queryOpts)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to query consul catalog nodes: {{err}}", err)
+	}
+
+	hosts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		hosts = append(hosts, node.Node)
+	}
+
+	return hosts, nil
+}
+
+// NomadInventory is an AllocInventory backed by the Nomad API.
+type NomadInventory struct {
+	client *nomadapi.Client
+}
+
+// NewNomadInventory returns an AllocInventory backed by the Nomad API.
+func NewNomadInventory(client *nomadapi.Client) *NomadInventory {
+	return &NomadInventory{client: client}
+}
+
+func (i *NomadInventory) Nodes(ctx context.Context) (map[string]string, error) {
+	queryOpts := &nomadapi.QueryOptions{
+		AllowStale: true,
+	}
+	nodes, _, err := i.client.Nodes().List(queryOpts)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to query Nomad nodes: {{err}}", err)
+	}
+
+	nodeIDs := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		nodeIDs[node.Name] = node.ID
+	}
+
+	return nodeIDs, nil
+}
+
+func (i *NomadInventory) NodeAllocs(ctx context.Context, nodeID string) (map[string]*nomadapi.Allocation, error) {
+	queryOpts := &nomadapi.QueryOptions{
+		AllowStale: true,
+	}
+	allocList, _, err := i.client.Nodes().Allocations(nodeID, queryOpts)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to query nomad allocations: {{err}}", err)
+	}
+
+	allocs := make(map[string]*nomadapi.Allocation, len(allocList))
+	for _, alloc := range allocList {
+		allocs[alloc.ID] = alloc
+	}
+
+	return allocs, nil
+}
+
+func (i *NomadInventory) LiveAllocs(ctx context.Context) ([]string, error) {
+	queryOpts := &nomadapi.QueryOptions{
+		AllowStale: true,
+	}
+	allocList, _, err := i.client.Allocations().List(queryOpts)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to query nomad allocations: {{err}}", err)
+	}
+
+	allocIDs := make([]string, 0, len(allocList))
+	for _, alloc := range allocList {
+		switch alloc.ClientStatus {
+		case "pending", "running":
+			allocIDs = append(allocIDs, alloc.ID)
+		}
+	}
+
+	return allocIDs, nil
+}
+
+func (i *NomadInventory) JobMeta(ctx context.Context, jobID string) (map[string]string, error) {
+	queryOpts := &nomadapi.QueryOptions{
+		AllowStale: true,
+	}
+	job, _, err := i.client.Jobs().Info(jobID, queryOpts)
+	if err != nil && isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to query nomad job: {{err}}", err)
+	}
+
+	return job.Meta, nil
+}
+
+func (i *NomadInventory) Alloc(ctx context.Context, allocID string) (*nomadapi.Allocation, error) {
+	queryOpts := &nomadapi.QueryOptions{
+		AllowStale: true,
+	}
+	alloc, _, err := i.client.Allocations().Info(allocID, queryOpts)
+	if err != nil && isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to query nomad alloc: {{err}}", err)
+	}
+
+	return alloc, nil
+}
+
+// isNotFound returns true if err is a 404 from the Circonus, Consul or Nomad
+// API.  None of the vendored clients return typed errors.
+func isNotFound(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "response code: 404") || strings.Contains(msg, "response code 404")
+}
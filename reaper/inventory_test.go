@@ -0,0 +1,80 @@
+package reaper
+
+import (
+	"context"
+	"sync"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// fakeAllocInventory is an in-memory AllocInventory that counts its lookups.
+type fakeAllocInventory struct {
+	mu sync.Mutex
+
+	nodes   map[string]string
+	allocs  map[string]*nomadapi.Allocation
+	jobMeta map[string]map[string]string
+
+	// jobErr and allocErr, if set, are returned by every JobMeta and Alloc.
+	jobErr   error
+	allocErr error
+
+	jobLookups   int
+	allocLookups int
+}
+
+func (i *fakeAllocInventory) Nodes(ctx context.Context) (map[string]string, error) {
+	return i.nodes, nil
+}
+
+func (i *fakeAllocInventory) NodeAllocs(ctx context.Context, nodeID string) (map[string]*nomadapi.Allocation, error) {
+	allocs := make(map[string]*nomadapi.Allocation)
+	for id, alloc := range i.allocs {
+		if alloc.NodeID == nodeID {
+			allocs[id] = alloc
+		}
+	}
+
+	return allocs, nil
+}
+
+func (i *fakeAllocInventory) LiveAllocs(ctx context.Context) ([]string, error) {
+	var ids []string
+	for id := range i.allocs {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (i *fakeAllocInventory) JobMeta(ctx context.Context, jobID string) (map[string]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.jobLookups++
+	if i.jobErr != nil {
+		return nil, i.jobErr
+	}
+	meta, found := i.jobMeta[jobID]
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return meta, nil
+}
+
+func (i *fakeAllocInventory) Alloc(ctx context.Context, allocID string) (*nomadapi.Allocation, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.allocLookups++
+	if i.allocErr != nil {
+		return nil, i.allocErr
+	}
+	alloc, found := i.allocs[allocID]
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return alloc, nil
+}
@@ -0,0 +1,228 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// nomadPolicyMetaKey is the Nomad job meta key job owners set to control how
+// the metrics of their finished allocs are reaped.
+const nomadPolicyMetaKey = "circonus_reaper_policy"
+
+// Per-job policies for the metrics of finished allocs.
+const (
+	NomadPolicyKeep      = "keep"
+	NomadPolicyImmediate = "immediate"
+	NomadPolicyDelay     = "delay"
+)
+
+// NomadJobPolicy says when the metrics of a job's finished allocs are
+// reaped.  The zero value reaps them immediately.
+type NomadJobPolicy struct {
+	action string
+	delay  time.Duration
+}
+
+func (p NomadJobPolicy) String() string {
+	if p.action == NomadPolicyDelay {
+		return fmt.Sprintf("%s:%s", p.action, p.delay)
+	}
+
+	return p.action
+}
+
+// ParseNomadJobPolicy parses "keep", "immediate" or "delay:<duration>".
+func ParseNomadJobPolicy(s string) (NomadJobPolicy, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	switch parts[0] {
+	case NomadPolicyKeep, NomadPolicyImmediate:
+		if len(parts) > 1 {
+			return NomadJobPolicy{}, fmt.Errorf("policy %q does not take an argument", parts[0])
+		}
+		return NomadJobPolicy{action: parts[0]}, nil
+	case NomadPolicyDelay:
+		if len(parts) < 2 {
+			return NomadJobPolicy{}, fmt.Errorf("policy %q requires a duration, e.g. delay:2h", parts[0])
+		}
+		delay, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return NomadJobPolicy{}, fmt.Errorf("invalid delay %q: %v", parts[1], err)
+		}
+		if delay <= 0 {
+			return NomadJobPolicy{}, fmt.Errorf("invalid delay %q: must be positive", parts[1])
+		}
+		return NomadJobPolicy{action: NomadPolicyDelay, delay: delay}, nil
+	default:
+		return NomadJobPolicy{}, fmt.Errorf("unknown policy %q", s)
+	}
+}
+
+// jobPolicy returns the reaping policy from the job's meta, falling back
+// to the default policy if the job's policy is missing or invalid.  It returns
+// nil if the job is gone.  Policies are cached for the duration of the run.
+// Any other error looking up the job is returned: the job's policy is unknown.
+func (c *Reaper) jobPolicy(ctx context.Context, jobID string) (*NomadJobPolicy, error) {
+	if policy, found := c.jobPolicyCache[jobID]; found {
+		return policy, nil
+	}
+
+	var meta map[string]string
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		meta, err = c.allocs.JobMeta(ctx, jobID)
+		return err
+	})
+	c.observeAPICall("NomadJobInfo", start, err)
+	switch {
+	case err == ErrNotFound:
+		c.jobPolicyCache[jobID] = nil
+		return nil, nil
+	case err != nil:
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to look up nomad job %q: {{err}}", jobID), err)
+	}
+
+	policy := c.nomadDefaultPolicy
+	if meta[nomadPolicyMetaKey] != "" {
+		p, err := ParseNomadJobPolicy(meta[nomadPolicyMetaKey])
+		if err != nil {
+			c.log.Warn("invalid reaper policy in nomad job meta, using default policy", "job", jobID, "policy", policy.String(), "error", err)
+		} else {
+			policy = p
+		}
+	}
+
+	c.jobPolicyCache[jobID] = &policy
+
+	return &policy, nil
+}
+
+// allocJobPolicy returns the policy of the alloc's job.  The job is looked up
+// by jobName, the job as it appears in the metric name.  Only if no job goes
+// by that name, because the job is gone or its name was mangled in the
+// metric, is the alloc looked up for its job ID.  The default policy is used
+// if neither the alloc nor its job can be found.
+func (c *Reaper) allocJobPolicy(ctx context.Context, jobName, allocID string) (NomadJobPolicy, error) {
+	policy, err := c.jobPolicy(ctx, jobName)
+	if err != nil {
+		return NomadJobPolicy{}, err
+	}
+	if policy != nil {
+		return *policy, nil
+	}
+
+	alloc, err := c.nomadAlloc(ctx, allocID)
+	if err != nil {
+		return NomadJobPolicy{}, err
+	}
+	if alloc != nil && alloc.JobID != jobName {
+		policy, err = c.jobPolicy(ctx, alloc.JobID)
+		if err != nil {
+			return NomadJobPolicy{}, err
+		}
+		if policy != nil {
+			return *policy, nil
+		}
+	}
+
+	c.log.Debug("nomad job is gone, using default policy", "job", jobName, "alloc_id", allocID, "policy", c.nomadDefaultPolicy.String())
+
+	return c.nomadDefaultPolicy, nil
+}
+
+// allocReapable returns true if the metrics of a finished alloc, or of a task
+// a live alloc no longer runs, may be deactivated now according to its job's
+// policy.  If not, the reason is returned.  The alloc itself is only looked up
+// to apply a delay, which for a live alloc runs from its last task event.  An
+// error is returned if the alloc or its job can't be looked up, in which case
+// the metrics must be kept.
+func (c *Reaper) allocReapable(ctx context.Context, jobName, allocID string) (bool, string, error) {
+	policy, err := c.allocJobPolicy(ctx, jobName, allocID)
+	if err != nil {
+		return false, "", err
+	}
+
+	switch policy.action {
+	case NomadPolicyKeep:
+		return false, reasonJobPolicyKeep, nil
+	case NomadPolicyDelay:
+		alloc, err := c.nomadAlloc(ctx, allocID)
+		if err != nil {
+			return false, "", err
+		}
+		if alloc == nil {
+			// NOTE(sean@): an alloc that has already been garbage collected
+			// finished long enough ago that there is nothing left to wait for.
+			return true, "", nil
+		}
+
+		reapableAt := nomadAllocFinishedAt(alloc).Add(policy.delay)
+		if time.Now().Before(reapableAt) {
+			c.delayAlloc(alloc.NodeID, reapableAt)
+			return false, reasonJobPolicyDelay, nil
+		}
+	}
+
+	return true, "", nil
+}
+
+// nomadAlloc looks up an alloc, including its task states.  It returns nil if
+// the alloc is gone, e.g. because it was garbage collected.  Allocs are cached
+// for the duration of the run.
+func (c *Reaper) nomadAlloc(ctx context.Context, allocID string) (*nomadapi.Allocation, error) {
+	if alloc, found := c.allocCache[allocID]; found {
+		return alloc, nil
+	}
+
+	var alloc *nomadapi.Allocation
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		alloc, err = c.allocs.Alloc(ctx, allocID)
+		return err
+	})
+	c.observeAPICall("NomadAllocationInfo", start, err)
+	switch {
+	case err == ErrNotFound:
+		alloc = nil
+	case err != nil:
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to look up nomad alloc %q: {{err}}", allocID), err)
+	}
+
+	c.allocCache[allocID] = alloc
+
+	return alloc, nil
+}
+
+// delayAlloc remembers that the allocs on a Nomad node become reapable at
+// reapableAt so that Watch can reconcile the node again once they do.
+func (c *Reaper) delayAlloc(nodeID string, reapableAt time.Time) {
+	if due, found := c.delayedAllocNodes[nodeID]; !found || reapableAt.Before(due) {
+		c.delayedAllocNodes[nodeID] = reapableAt
+	}
+}
+
+// nomadAllocFinishedAt returns the time of the alloc's last task event, or
+// the time the alloc was created if it has no task events.
+func nomadAllocFinishedAt(alloc *nomadapi.Allocation) time.Time {
+	var last int64
+	for _, state := range alloc.TaskStates {
+		if state == nil {
+			continue
+		}
+		for _, event := range state.Events {
+			if event != nil && event.Time > last {
+				last = event.Time
+			}
+		}
+	}
+
+	if last == 0 {
+		last = alloc.CreateTime
+	}
+
+	return time.Unix(0, last)
+}
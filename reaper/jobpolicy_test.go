@@ -0,0 +1,179 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+func TestParseNomadJobPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    NomadJobPolicy
+		wantErr bool
+	}{
+		{in: "keep", want: NomadJobPolicy{action: NomadPolicyKeep}},
+		{in: "immediate", want: NomadJobPolicy{action: NomadPolicyImmediate}},
+		{in: " immediate ", want: NomadJobPolicy{action: NomadPolicyImmediate}},
+		{in: "delay:2h", want: NomadJobPolicy{action: NomadPolicyDelay, delay: 2 * time.Hour}},
+		{in: "delay:90s", want: NomadJobPolicy{action: NomadPolicyDelay, delay: 90 * time.Second}},
+		{in: "keep:1h", wantErr: true},
+		{in: "immediate:", wantErr: true},
+		{in: "delay", wantErr: true},
+		{in: "delay:soon", wantErr: true},
+		{in: "delay:0s", wantErr: true},
+		{in: "delay:-1h", wantErr: true},
+		{in: "Keep", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseNomadJobPolicy(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseNomadJobPolicy(%q) = %v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseNomadJobPolicy(%q) error: %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseNomadJobPolicy(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestAllocReapable(t *testing.T) {
+	const allocID = "0123abcd-0123-4567-89ab-0123456789ab"
+	finished := time.Now().Add(-30 * time.Minute)
+
+	f := newFakeCirconus(t)
+	defer f.Close()
+
+	tests := []struct {
+		name             string
+		jobName          string
+		defaultPolicy    string
+		jobMeta          map[string]map[string]string
+		alloc            *nomadapi.Allocation
+		jobErr           error
+		allocErr         error
+		want             bool
+		wantReason       string
+		wantErr          bool
+		wantAllocLookups int
+	}{
+		{
+			name:    "immediate",
+			jobName: "web",
+			jobMeta: map[string]map[string]string{"web": {nomadPolicyMetaKey: NomadPolicyImmediate}},
+			want:    true,
+		},
+		{
+			name:       "keep",
+			jobName:    "web",
+			jobMeta:    map[string]map[string]string{"web": {nomadPolicyMetaKey: NomadPolicyKeep}},
+			wantReason: reasonJobPolicyKeep,
+		},
+		{
+			name:          "default policy",
+			jobName:       "web",
+			defaultPolicy: NomadPolicyKeep,
+			jobMeta:       map[string]map[string]string{"web": {}},
+			wantReason:    reasonJobPolicyKeep,
+		},
+		{
+			name:             "delay not yet passed",
+			jobName:          "web",
+			jobMeta:          map[string]map[string]string{"web": {nomadPolicyMetaKey: "delay:1h"}},
+			alloc:            &nomadapi.Allocation{ID: allocID, JobID: "web", CreateTime: finished.UnixNano()},
+			wantReason:       reasonJobPolicyDelay,
+			wantAllocLookups: 1,
+		},
+		{
+			name:             "delay passed",
+			jobName:          "web",
+			jobMeta:          map[string]map[string]string{"web": {nomadPolicyMetaKey: "delay:10m"}},
+			alloc:            &nomadapi.Allocation{ID: allocID, JobID: "web", CreateTime: finished.UnixNano()},
+			want:             true,
+			wantAllocLookups: 1,
+		},
+		{
+			name:             "delay on garbage collected alloc",
+			jobName:          "web",
+			jobMeta:          map[string]map[string]string{"web": {nomadPolicyMetaKey: "delay:1h"}},
+			want:             true,
+			wantAllocLookups: 1,
+		},
+		{
+			name:             "job name mangled in metric",
+			jobName:          "web_api",
+			jobMeta:          map[string]map[string]string{"web api": {nomadPolicyMetaKey: NomadPolicyKeep}},
+			alloc:            &nomadapi.Allocation{ID: allocID, JobID: "web api", CreateTime: finished.UnixNano()},
+			wantReason:       reasonJobPolicyKeep,
+			wantAllocLookups: 1,
+		},
+		{
+			name:             "job and alloc gone",
+			jobName:          "web",
+			defaultPolicy:    NomadPolicyKeep,
+			wantReason:       reasonJobPolicyKeep,
+			wantAllocLookups: 1,
+		},
+		{
+			name:    "job lookup fails",
+			jobName: "web",
+			jobErr:  errors.New("connection refused"),
+			wantErr: true,
+		},
+		{
+			name:             "alloc lookup fails",
+			jobName:          "web",
+			jobMeta:          map[string]map[string]string{"web": {nomadPolicyMetaKey: "delay:1h"}},
+			allocErr:         errors.New("connection refused"),
+			wantErr:          true,
+			wantAllocLookups: 1,
+		},
+	}
+
+	for _, test := range tests {
+		inv := &fakeAllocInventory{
+			allocs:   map[string]*nomadapi.Allocation{},
+			jobMeta:  test.jobMeta,
+			jobErr:   test.jobErr,
+			allocErr: test.allocErr,
+		}
+		if test.alloc != nil {
+			inv.allocs[allocID] = test.alloc
+		}
+
+		cfg := Config{Allocs: inv}
+		if test.defaultPolicy != "" {
+			policy, err := ParseNomadJobPolicy(test.defaultPolicy)
+			if err != nil {
+				t.Fatalf("%s: ParseNomadJobPolicy(%q) error: %v", test.name, test.defaultPolicy, err)
+			}
+			cfg.NomadDefaultPolicy = policy
+		}
+		c := newTestReaper(t, f, cfg)
+
+		got, reason, err := c.allocReapable(context.Background(), test.jobName, allocID)
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("%s: allocReapable() = %v, %q, want error", test.name, got, reason)
+		case !test.wantErr && err != nil:
+			t.Errorf("%s: allocReapable() error: %v", test.name, err)
+		case got != test.want || reason != test.wantReason:
+			t.Errorf("%s: allocReapable() = %v, %q, want %v, %q", test.name, got, reason, test.want, test.wantReason)
+		}
+
+		if inv.allocLookups != test.wantAllocLookups {
+			t.Errorf("%s: looked up the alloc %d times, want %d", test.name, inv.allocLookups, test.wantAllocLookups)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package reaper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// journal is an append-only file of JSON lines recording the full state of
+// every object the reaper is about to modify or delete so that it can be
+// recreated by hand.
+type journal struct {
+	lock sync.Mutex
+	path string
+}
+
+type journalEntry struct {
+	Time       time.Time       `json:"time"`
+	RunID      string          `json:"run_id"`
+	Action     string          `json:"action"`
+	ObjectType string          `json:"object_type"`
+	CID        string          `json:"cid"`
+	Object     json.RawMessage `json:"object"`
+}
+
+func newJournal(path string) (*journal, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	// Fail early if the journal can't be written to.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to open journal %q: {{err}}", path), err)
+	}
+	f.Close()
+
+	return &journal{path: path}, nil
+}
+
+// Record appends obj to the journal and syncs it to disk.  Callers must not
+// modify the object if Record returns an error.
+func (j *journal) Record(runID, action, objectType, cid string, obj interface{}) error {
+	if j == nil {
+		return fmt.Errorf("no journal configured")
+	}
+
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to encode %s %q: {{err}}", objectType, cid), err)
+	}
+
+	entryJSON, err := json.Marshal(journalEntry{
+		Time:       time.Now().UTC(),
+		RunID:      runID,
+		Action:     action,
+		ObjectType: objectType,
+		CID:        cid,
+		Object:     objJSON,
+	})
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to encode journal entry for %q: {{err}}", cid), err)
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to open journal %q: {{err}}", j.path), err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(entryJSON, '\n')); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to write journal %q: {{err}}", j.path), err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to sync journal %q: {{err}}", j.path), err)
+	}
+
+	return nil
+}
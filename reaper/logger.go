@@ -0,0 +1,167 @@
+package reaper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats.
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// LogLevel is the severity of a log event.
+type LogLevel int
+
+const (
+	LevelTrace LogLevel = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LevelTrace: "trace",
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses a level name such as "info".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Logger writes leveled log events with a consistent set of key/value
+// fields.  Fields attached with With are included in every event.
+type Logger struct {
+	out    *lockedWriter
+	level  LogLevel
+	format string
+	fields []interface{}
+}
+
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewLogger returns a logger that writes events at level or above to w in
+// format.
+func NewLogger(w io.Writer, level LogLevel, format string) *Logger {
+	return &Logger{
+		out:    &lockedWriter{w: w},
+		level:  level,
+		format: format,
+	}
+}
+
+// With returns a logger that adds the given key/value pairs to every event.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{
+		out:    l.out,
+		level:  l.level,
+		format: l.format,
+		fields: fields,
+	}
+}
+
+func (l *Logger) Trace(msg string, kv ...interface{}) { l.log(LevelTrace, msg, kv) }
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	fields := make(map[string]interface{}, (len(l.fields)+len(kv))/2)
+	for _, pairs := range [][]interface{}{l.fields, kv} {
+		for i := 0; i < len(pairs); i += 2 {
+			key := fmt.Sprint(pairs[i])
+			if i+1 >= len(pairs) {
+				fields[key] = nil
+				continue
+			}
+
+			switch v := pairs[i+1].(type) {
+			case error:
+				fields[key] = v.Error()
+			default:
+				fields[key] = v
+			}
+		}
+	}
+
+	var line string
+	now := time.Now().UTC().Format(time.RFC3339)
+	switch l.format {
+	case LogFormatJSON:
+		fields["time"] = now
+		fields["level"] = level.String()
+		fields["msg"] = msg
+		buf, err := json.Marshal(fields)
+		if err != nil {
+			buf, _ = json.Marshal(map[string]string{
+				"time":  now,
+				"level": LevelError.String(),
+				"msg":   fmt.Sprintf("unable to encode log event %q: %v", msg, err),
+			})
+		}
+		line = string(buf)
+	default:
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		parts := make([]string, 0, len(keys)+3)
+		parts = append(parts, now, fmt.Sprintf("level=%s", level), fmt.Sprintf("msg=%q", msg))
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s=%q", k, fmt.Sprint(fields[k])))
+		}
+		line = strings.Join(parts, " ")
+	}
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	fmt.Fprintln(l.out.w, line)
+}
+
+// newRunID returns a random identifier used to correlate every log event
+// emitted during a single run.
+func newRunID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(buf)
+}
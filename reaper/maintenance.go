@@ -0,0 +1,100 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/hashicorp/errwrap"
+)
+
+// Scopes for the maintenance windows created while reaping.
+const (
+	MaintenanceScopeCheck = "check"
+	MaintenanceScopeHost  = "host"
+)
+
+// withMaintenance runs update inside a short Circonus maintenance window so
+// that deactivating metrics or check bundles doesn't fire absence alerts.  The
+// window is scoped to either the target host or the given checks.  Windows
+// are removed once update succeeds; if update fails they are left to expire
+// on their own.  update is run directly if maintenance windows are disabled.
+// ctx is expected to come from beginUpdate.
+func (c *Reaper) withMaintenance(ctx context.Context, target string, checkCIDs []string, update func() error) error {
+	if c.maintenanceWindow <= 0 {
+		return update()
+	}
+
+	var items []string
+	switch c.maintenanceScope {
+	case MaintenanceScopeHost:
+		items = []string{target}
+	default:
+		items = checkCIDs
+	}
+
+	windows := make([]*circonusapi.Maintenance, 0, len(items))
+	now := time.Now()
+	for _, item := range items {
+		window := &circonusapi.Maintenance{
+			Item:       item,
+			Notes:      fmt.Sprintf("circonus-reaper run %s is deactivating metrics on %s", c.runID, target),
+			Severities: []string{"1", "2", "3", "4", "5"},
+			Start:      uint(now.Unix()),
+			Stop:       uint(now.Add(c.maintenanceWindow).Unix()),
+			Tags:       []string{},
+			Type:       c.maintenanceScope,
+		}
+
+		var created *circonusapi.Maintenance
+		start := time.Now()
+		err := c.updateCall(ctx, func() (err error) {
+			created, err = c.circonusClient.CreateMaintenanceWindow(window)
+			return err
+		})
+		c.observeAPICall("CreateMaintenanceWindow", start, err)
+
+		var cid string
+		if created != nil {
+			cid = created.CID
+		}
+		c.report.addAPICall("CreateMaintenanceWindow", cid, false, err)
+		if err != nil {
+			c.endMaintenance(ctx, target, windows)
+			return errwrap.Wrapf(fmt.Sprintf("unable to create maintenance window for %s %q: {{err}}", c.maintenanceScope, item), err)
+		}
+
+		c.log.Debug("created maintenance window", "target", target, "maintenance_cid", cid, "item", item)
+		windows = append(windows, created)
+	}
+
+	if err := update(); err != nil {
+		c.log.Warn("leaving maintenance windows to expire after failed update", "target", target, "expires", now.Add(c.maintenanceWindow).UTC().Format(time.RFC3339))
+		return err
+	}
+
+	c.endMaintenance(ctx, target, windows)
+
+	return nil
+}
+
+// endMaintenance removes the given maintenance windows.  Failures are logged
+// but otherwise ignored since the windows expire on their own.
+func (c *Reaper) endMaintenance(ctx context.Context, target string, windows []*circonusapi.Maintenance) {
+	for _, window := range windows {
+		start := time.Now()
+		err := c.updateCall(ctx, func() error {
+			_, err := c.circonusClient.DeleteMaintenanceWindow(window)
+			return err
+		})
+		c.observeAPICall("DeleteMaintenanceWindow", start, err)
+		c.report.addAPICall("DeleteMaintenanceWindow", window.CID, false, err)
+		if err != nil {
+			c.log.Warn("unable to delete maintenance window", "target", target, "maintenance_cid", window.CID, "error", err)
+			continue
+		}
+
+		c.log.Debug("deleted maintenance window", "target", target, "maintenance_cid", window.CID)
+	}
+}
@@ -0,0 +1,254 @@
+package reaper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const metricsServiceName = "circonus-reaper"
+
+// trapSink is a go-metrics MetricSink that buffers every value emitted during
+// a run so that it can be submitted to a Circonus HTTPTrap check in a single
+// request once the run completes.  Samples are kept individually so that the
+// broker can build a histogram from them.
+type trapSink struct {
+	lock sync.Mutex
+
+	counters map[string]float64
+	gauges   map[string]float64
+	samples  map[string][]float64
+}
+
+// trapValue is the explicitly typed metric format accepted by HTTPTrap checks.
+type trapValue struct {
+	Type  string      `json:"_type"`
+	Value interface{} `json:"_value"`
+}
+
+func newTrapSink() *trapSink {
+	return &trapSink{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		samples:  make(map[string][]float64),
+	}
+}
+
+func (s *trapSink) SetGauge(key []string, val float32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.gauges[s.flattenKey(key)] = float64(val)
+}
+
+func (s *trapSink) EmitKey(key []string, val float32) {
+	s.AddSample(key, val)
+}
+
+func (s *trapSink) IncrCounter(key []string, val float32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counters[s.flattenKey(key)] += float64(val)
+}
+
+func (s *trapSink) AddSample(key []string, val float32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	k := s.flattenKey(key)
+	s.samples[k] = append(s.samples[k], float64(val))
+}
+
+// Submit PUTs the buffered metrics to the HTTPTrap submission URL.
+func (s *trapSink) Submit(submissionURL string) error {
+	// Counters and samples describe a single run, so they are drained on every
+	// submission.  Gauges retain their last value.
+	s.lock.Lock()
+	payload := make(map[string]trapValue, len(s.counters)+len(s.gauges)+len(s.samples))
+	for k, v := range s.counters {
+		payload[k] = trapValue{Type: "n", Value: v}
+	}
+	for k, v := range s.gauges {
+		payload[k] = trapValue{Type: "n", Value: v}
+	}
+	for k, v := range s.samples {
+		payload[k] = trapValue{Type: "n", Value: v}
+	}
+	s.counters = make(map[string]float64)
+	s.samples = make(map[string][]float64)
+	s.lock.Unlock()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errwrap.Wrapf("unable to encode metrics: {{err}}", err)
+	}
+
+	req, err := http.NewRequest("PUT", submissionURL, bytes.NewReader(body))
+	if err != nil {
+		return errwrap.Wrapf("unable to create HTTPTrap request: {{err}}", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := cleanhttp.DefaultClient()
+	httpClient.Timeout = 30 * time.Second
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errwrap.Wrapf("unable to submit metrics: {{err}}", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTPTrap submission failed with %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+func (s *trapSink) flattenKey(parts []string) string {
+	return strings.Join(parts, "`")
+}
+
+// setupMetrics returns the reaper's own go-metrics instance, emitting to sink
+// and, if an HTTPTrap URL was configured, to the returned trap sink.  Metrics
+// are discarded if there is neither.  Nothing is installed globally.
+func setupMetrics(trapURL string, sink metrics.MetricSink) (*metrics.Metrics, *trapSink, error) {
+	var sinks metrics.FanoutSink
+	if sink != nil {
+		sinks = append(sinks, sink)
+	}
+
+	var trap *trapSink
+	if trapURL != "" {
+		trap = newTrapSink()
+		sinks = append(sinks, trap)
+	}
+
+	cfg := metrics.DefaultConfig(metricsServiceName)
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+
+	var m *metrics.Metrics
+	var err error
+	switch len(sinks) {
+	case 0:
+		m, err = metrics.New(cfg, &metrics.BlackholeSink{})
+	case 1:
+		m, err = metrics.New(cfg, sinks[0])
+	default:
+		m, err = metrics.New(cfg, sinks)
+	}
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("unable to setup metrics: {{err}}", err)
+	}
+
+	return m, trap, nil
+}
+
+// observeAPICall records the latency of a Circonus API call and counts it as
+// an error if it failed.
+func (c *Reaper) observeAPICall(operation string, start time.Time, err error) {
+	c.metrics.MeasureSince([]string{"api", operation, "latency"}, start)
+	if err != nil {
+		c.metrics.IncrCounter([]string{"errors", "api", operation}, 1)
+		c.apiErrors.Incr(operation)
+	}
+}
+
+// APIErrors returns the number of failed API calls by operation since the
+// reaper was created.
+func (c *Reaper) APIErrors() map[string]uint {
+	return c.apiErrors.Snapshot()
+}
+
+type labeledCounter struct {
+	lock   sync.Mutex
+	counts map[string]uint
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{counts: make(map[string]uint)}
+}
+
+func (l *labeledCounter) Incr(label string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.counts[label]++
+}
+
+// Snapshot returns a copy of the current counts.
+func (l *labeledCounter) Snapshot() map[string]uint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	m := make(map[string]uint, len(l.counts))
+	for k, v := range l.counts {
+		m[k] = v
+	}
+
+	return m
+}
+
+// submitMetrics emits the run's counters and timings and publishes them to
+// the configured HTTPTrap check, if any.
+func (c *Reaper) submitMetrics(runStart time.Time, runErr error) error {
+	mode := "live"
+	if c.dryRun {
+		mode = "dry_run"
+	}
+
+	c.metrics.MeasureSince([]string{"run", "duration"}, runStart)
+	c.metrics.SetGauge([]string{"run", "last_run"}, float32(time.Now().Unix()))
+	switch {
+	case runErr != nil:
+		c.metrics.IncrCounter([]string{"run", "failed"}, 1)
+	case c.numFailures() > 0:
+		c.metrics.IncrCounter([]string{"run", "partially_failed"}, 1)
+	default:
+		c.metrics.IncrCounter([]string{"run", "succeeded"}, 1)
+	}
+	c.metrics.SetGauge([]string{"run", "failures"}, float32(c.numFailures()))
+
+	c.metrics.SetGauge([]string{mode, "disabled_targets"}, float32(c.stats.DisabledTargets))
+	c.metrics.SetGauge([]string{mode, "deleted_targets"}, float32(c.stats.DeletedTargets))
+	c.metrics.SetGauge([]string{mode, "excluded_targets"}, float32(c.stats.ExcludedTargets))
+	c.metrics.SetGauge([]string{mode, "reactivated_targets"}, float32(c.stats.ReactivatedTargets))
+	c.metrics.SetGauge([]string{mode, "disabled_metrics"}, float32(c.stats.DisabledMetrics))
+	c.metrics.SetGauge([]string{mode, "enabled_metrics"}, float32(c.stats.EnabledMetrics))
+	c.metrics.SetGauge([]string{mode, "edited_metrics"}, float32(c.stats.EditedMetrics))
+	c.metrics.SetGauge([]string{mode, "dangling_rule_sets"}, float32(c.stats.DanglingRuleSets))
+	c.metrics.SetGauge([]string{"broken_visualizations"}, float32(c.stats.BrokenVisualizations))
+	c.metrics.SetGauge([]string{"empty_metric_clusters"}, float32(c.stats.EmptyMetricClusters))
+	c.metrics.SetGauge([]string{"orphaned_broker_bundles"}, float32(c.stats.OrphanedBrokerBundles))
+	c.metrics.SetGauge([]string{mode, "stale_metrics"}, float32(c.stats.StaleMetrics))
+	c.metrics.SetGauge([]string{mode, "shed_metrics"}, float32(c.stats.ShedMetrics))
+	c.metrics.SetGauge([]string{"unknown_status_metrics"}, float32(c.stats.UnknownStatusMetrics))
+	c.metrics.SetGauge([]string{"nomad", "clients"}, float32(c.stats.NomadClients))
+	c.metrics.SetGauge([]string{"nomad", "live_allocs"}, float32(c.stats.LiveAllocs))
+	c.metrics.SetGauge([]string{"nomad", "active_alloc_metrics"}, float32(c.stats.ActiveNomadAllocMetrics))
+	c.metrics.SetGauge([]string{"nomad", "available_alloc_metrics"}, float32(c.stats.AvailableNomadAllocMetrics))
+	c.metrics.SetGauge([]string{"nomad", "removed_task_metrics"}, float32(c.stats.RemovedNomadTaskMetrics))
+
+	if c.metricsSink == nil {
+		return nil
+	}
+
+	if err := c.metricsSink.Submit(c.metricsTrapURL); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to submit metrics to %q: {{err}}", c.metricsTrapURL), err)
+	}
+
+	return nil
+}
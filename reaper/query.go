@@ -0,0 +1,291 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+)
+
+// Actions query mode can take on the metrics matching its queries.
+const (
+	QueryActionDeactivate = "deactivate"
+	QueryActionActivate   = "activate"
+	QueryActionAddTag     = "add-tag"
+	QueryActionRemoveTag  = "remove-tag"
+	QueryActionSetUnits   = "set-units"
+)
+
+// queryUpdateAttempts is the number of times a check bundle's metrics are
+// re-read and the query action re-applied when the bundle was seen to change
+// while the update was being prepared.
+const queryUpdateAttempts = 3
+
+var errCheckBundleModified = errors.New("check bundle was modified while the update was prepared")
+
+// applyMatchingQueries applies the configured query action to every metric
+// matching any of the queries.  Matches are grouped so each check bundle is
+// updated once.  Failed searches and bundle updates are recorded as failures
+// rather than aborting the run.
+func (c *Reaper) applyMatchingQueries(ctx context.Context) error {
+	// map[CheckBundleCID]map[metric.MetricName]struct{}
+	checkBundles := make(map[string]map[string]struct{})
+	for _, query := range c.metricQueries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		c.log.Debug("searching for metrics", "query", query)
+		searchQuery := circonusapi.SearchQueryType(query)
+		filter := circonusapi.SearchFilterType{
+			"size": []string{"1000"},
+		}
+
+		var metrics *[]circonusapi.Metric
+		start := time.Now()
+		err := c.apiCall(ctx, func() (err error) {
+			metrics, err = c.circonusClient.SearchMetrics(&searchQuery, &filter)
+			return err
+		})
+		c.observeAPICall("SearchMetrics", start, err)
+		c.report.addAPICall("SearchMetrics", config.MetricPrefix, false, err)
+		if err != nil {
+			c.log.Error("unable to search for metrics", "query", query, "error", err)
+			c.recordFailure(failureKindQuery, query, err)
+			continue
+		}
+
+		if metrics == nil {
+			continue
+		}
+
+		for _, metric := range *metrics {
+			if _, found := checkBundles[metric.CheckBundleCID]; !found {
+				checkBundles[metric.CheckBundleCID] = make(map[string]struct{})
+			}
+			checkBundles[metric.CheckBundleCID][metric.MetricName] = struct{}{}
+		}
+	}
+
+	checkBundleCIDs := make([]string, 0, len(checkBundles))
+	for checkBundleCID := range checkBundles {
+		checkBundleCIDs = append(checkBundleCIDs, checkBundleCID)
+	}
+	sort.Strings(checkBundleCIDs)
+
+	for _, cbid := range checkBundleCIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := c.applyQueryAction(ctx, cbid, checkBundles[cbid]); err != nil {
+			c.log.Error("unable to apply query action", "check_bundle_cid", cbid, "action", c.queryAction, "error", err)
+			c.recordFailure(failureKindCheckBundle, cbid, err)
+
+			// NOTE(sean@): treat errors as soft because we want to try updating
+			// check_bundle_metrics for all bundles vs getting hung up on a
+			// single bundle that may be failing for some reason.
+			continue
+		}
+	}
+
+	return nil
+}
+
+// applyQueryAction applies the query action to the matched metrics on a single
+// check bundle via its check_bundle_metrics.  If the bundle is seen to have
+// been modified while the update was being prepared the update is abandoned
+// and retried against the fresh metrics.
+func (c *Reaper) applyQueryAction(ctx context.Context, cbid string, matched map[string]struct{}) error {
+	var err error
+	for attempt := 1; attempt <= queryUpdateAttempts; attempt++ {
+		if err = c.tryQueryAction(ctx, cbid, matched); err != errCheckBundleModified {
+			return err
+		}
+
+		c.log.Warn("check bundle was modified while the update was prepared, retrying", "check_bundle_cid", cbid, "attempt", attempt)
+	}
+
+	return errwrap.Wrapf(fmt.Sprintf("unable to update check bundle metrics %q: {{err}}", cbid), err)
+}
+
+func (c *Reaper) tryQueryAction(ctx context.Context, cbid string, matched map[string]struct{}) error {
+	c.log.Debug("fetching check bundle", "check_bundle_cid", cbid)
+	checkBundle, err := c.fetchCheckBundle(ctx, cbid)
+	if err != nil {
+		return err
+	}
+
+	if c.excludeTarget(checkBundle.Target) {
+		c.log.Info("skipping metrics on excluded target", "target", checkBundle.Target, "check_bundle_cid", cbid, "action", decisionSkip)
+		for metricName := range matched {
+			c.report.addMetric(checkBundle.Target, cbid, metricName, "", decisionSkip, reasonExcluded)
+		}
+		return nil
+	}
+
+	cbm, err := c.fetchCheckBundleMetrics(ctx, cbid)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is reported until the update has gone through so that a retry
+	// doesn't report the same metric twice.
+	var changed, skipped []circonusapi.CheckBundleMetric
+	for i, metric := range cbm.Metrics {
+		if _, found := matched[metric.Name]; !found {
+			continue
+		}
+
+		status, ok := c.metricStatusOf(checkBundle.Target, cbid, &cbm.Metrics[i])
+		if !ok {
+			continue
+		}
+
+		if c.applyQueryActionToMetric(&cbm.Metrics[i], status) {
+			changed = append(changed, metric)
+		} else {
+			skipped = append(skipped, metric)
+		}
+	}
+
+	if len(changed) > 0 {
+		if !c.dryRun {
+			if err := c.checkBundleUnmodified(ctx, checkBundle); err != nil {
+				return err
+			}
+		}
+
+		if err := c.updateCheckBundleMetrics(ctx, checkBundle.Target, cbid, checkBundle.Checks, cbm); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to update check bundle metrics %q: {{err}}", cbm.CID), err)
+		}
+	}
+
+	for _, metric := range skipped {
+		c.log.Trace("skipping metric", "target", checkBundle.Target, "check_bundle_cid", cbid, "metric", metric.Name, "action", decisionSkip)
+		c.report.addMetric(checkBundle.Target, cbid, metric.Name, metric.Status, decisionSkip, queryActionNoopReason(c.queryAction))
+	}
+
+	for _, metric := range changed {
+		c.log.Info("applied query action to metric", "target", checkBundle.Target, "check_bundle_cid", cbid, "metric", metric.Name, "action", c.queryAction)
+		c.report.addMetric(checkBundle.Target, cbid, metric.Name, metric.Status, c.queryAction, reasonMatchedQuery)
+
+		switch c.queryAction {
+		case QueryActionDeactivate:
+			c.recordReapedMetric(checkBundle.Target, checkBundle.Checks, metric.Name)
+			c.stats.DisabledMetrics++
+		case QueryActionActivate:
+			c.stats.EnabledMetrics++
+		default:
+			c.stats.EditedMetrics++
+		}
+	}
+
+	return nil
+}
+
+func (c *Reaper) fetchCheckBundle(ctx context.Context, cbid string) (*circonusapi.CheckBundle, error) {
+	var checkBundle *circonusapi.CheckBundle
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		checkBundle, err = c.circonusClient.FetchCheckBundle(circonusapi.CIDType(&cbid))
+		return err
+	})
+	c.observeAPICall("FetchCheckBundle", start, err)
+	c.report.addAPICall("FetchCheckBundle", cbid, false, err)
+	if err != nil && isNotFound(err) {
+		c.evictCachedCheckBundle(cbid)
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to fetch check bundle %q: {{err}}", cbid), err)
+	}
+
+	return checkBundle, nil
+}
+
+// checkBundleUnmodified re-reads the check bundle and returns
+// errCheckBundleModified if its _last_modified has moved since it was fetched.
+// It is a best-effort check, not a concurrency guard: the Circonus API has no
+// conditional updates, so a change made between this check and the update is
+// still overwritten.
+func (c *Reaper) checkBundleUnmodified(ctx context.Context, checkBundle *circonusapi.CheckBundle) error {
+	current, err := c.fetchCheckBundle(ctx, checkBundle.CID)
+	if err != nil {
+		return err
+	}
+
+	if current.LastModified != checkBundle.LastModified {
+		c.log.Debug("check bundle modified since it was fetched", "check_bundle_cid", checkBundle.CID, "last_modified", checkBundle.LastModified, "current_last_modified", current.LastModified)
+		return errCheckBundleModified
+	}
+
+	return nil
+}
+
+// applyQueryActionToMetric applies the query action to metric, whose status is
+// status, and returns true if the metric was changed.
+func (c *Reaper) applyQueryActionToMetric(metric *circonusapi.CheckBundleMetric, status metricStatus) bool {
+	switch c.queryAction {
+	case QueryActionDeactivate:
+		if status != metricStatusActive {
+			return false
+		}
+		metric.Status = string(metricStatusAvailable)
+	case QueryActionActivate:
+		if status == metricStatusActive {
+			return false
+		}
+		metric.Status = string(metricStatusActive)
+	case QueryActionAddTag:
+		for _, tag := range metric.Tags {
+			if tag == c.queryTag {
+				return false
+			}
+		}
+		metric.Tags = append(metric.Tags, c.queryTag)
+	case QueryActionRemoveTag:
+		tags := make([]string, 0, len(metric.Tags))
+		for _, tag := range metric.Tags {
+			if tag != c.queryTag {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == len(metric.Tags) {
+			return false
+		}
+		metric.Tags = tags
+	case QueryActionSetUnits:
+		if metric.Units != nil && *metric.Units == c.queryUnits {
+			return false
+		}
+		units := c.queryUnits
+		metric.Units = &units
+	default:
+		return false
+	}
+
+	return true
+}
+
+// queryActionNoopReason explains why the query action left a metric alone.
+func queryActionNoopReason(action string) string {
+	switch action {
+	case QueryActionDeactivate:
+		return reasonAlreadyAvailable
+	case QueryActionActivate:
+		return reasonAlreadyActive
+	case QueryActionAddTag:
+		return "already tagged"
+	case QueryActionRemoveTag:
+		return "not tagged"
+	case QueryActionSetUnits:
+		return "units unchanged"
+	default:
+		return ""
+	}
+}
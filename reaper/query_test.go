@@ -0,0 +1,144 @@
+package reaper
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func TestApplyMatchingQueries(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		tag    string
+		dryRun bool
+		// cpuStatus is the status of the matched metric before the run.
+		cpuStatus string
+		// touches is how many times the bundle is modified elsewhere while
+		// its metrics are being fetched.
+		touches      int
+		wantStatus   string
+		wantTags     []string
+		wantFetches  int
+		wantPuts     int
+		wantChanged  uint
+		wantFailures int
+	}{
+		{
+			name:        "deactivate",
+			action:      QueryActionDeactivate,
+			cpuStatus:   "active",
+			wantStatus:  "available",
+			wantTags:    []string{},
+			wantFetches: 1,
+			wantPuts:    1,
+			wantChanged: 1,
+		},
+		{
+			name:        "already available",
+			action:      QueryActionDeactivate,
+			cpuStatus:   "available",
+			wantStatus:  "available",
+			wantTags:    []string{},
+			wantFetches: 1,
+		},
+		{
+			name:        "add tag",
+			action:      QueryActionAddTag,
+			tag:         "team:ops",
+			cpuStatus:   "active",
+			wantStatus:  "active",
+			wantTags:    []string{"team:ops"},
+			wantFetches: 1,
+			wantPuts:    1,
+			wantChanged: 1,
+		},
+		{
+			name:        "dry run",
+			action:      QueryActionDeactivate,
+			dryRun:      true,
+			cpuStatus:   "active",
+			wantStatus:  "active",
+			wantTags:    []string{},
+			wantFetches: 1,
+			wantChanged: 1,
+		},
+		{
+			name:        "modified once and retried",
+			action:      QueryActionDeactivate,
+			cpuStatus:   "active",
+			touches:     1,
+			wantStatus:  "available",
+			wantTags:    []string{},
+			wantFetches: 2,
+			wantPuts:    1,
+			wantChanged: 1,
+		},
+		{
+			name:         "modified on every attempt",
+			action:       QueryActionDeactivate,
+			cpuStatus:    "active",
+			touches:      queryUpdateAttempts,
+			wantStatus:   "active",
+			wantTags:     []string{},
+			wantFetches:  queryUpdateAttempts,
+			wantFailures: 1,
+		},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1", "cpu", "memory")
+		f.checkBundleMetrics["/check_bundle/1"].Metrics[0].Status = test.cpuStatus
+		f.metrics = append(f.metrics, circonusapi.Metric{
+			Active:         test.cpuStatus == "active",
+			CheckBundleCID: "/check_bundle/1",
+			CheckCID:       "/check/1",
+			CID:            "/metric/1_cpu",
+			MetricName:     "cpu",
+		})
+
+		touches := test.touches
+		f.onRequest = func(req string) {
+			if req == "GET /check_bundle_metrics/1" && touches > 0 {
+				touches--
+				f.touch("/check_bundle/1")
+			}
+		}
+
+		c := newTestReaper(t, f, Config{
+			Mode:          ModeQuery,
+			MetricQueries: []string{"cpu"},
+			QueryAction:   test.action,
+			QueryTag:      test.tag,
+			DryRun:        test.dryRun,
+		})
+		if err := c.applyMatchingQueries(context.Background()); err != nil {
+			t.Errorf("%s: applyMatchingQueries() = %v", test.name, err)
+		}
+
+		statuses := f.metricStatuses("/check_bundle/1")
+		if statuses["cpu"] != test.wantStatus || statuses["memory"] != "active" {
+			t.Errorf("%s: metric statuses %v, want cpu %s and memory active", test.name, statuses, test.wantStatus)
+		}
+		if tags := f.checkBundleMetrics["/check_bundle/1"].Metrics[0].Tags; !reflect.DeepEqual(tags, test.wantTags) {
+			t.Errorf("%s: cpu tags %v, want %v", test.name, tags, test.wantTags)
+		}
+		if got := f.countRequests("GET /check_bundle_metrics/1"); got != test.wantFetches {
+			t.Errorf("%s: fetched the metrics %d times, want %d", test.name, got, test.wantFetches)
+		}
+		if got := f.countRequests("PUT /check_bundle_metrics/1"); got != test.wantPuts {
+			t.Errorf("%s: updated the metrics %d times, want %d", test.name, got, test.wantPuts)
+		}
+		if changed := c.stats.DisabledMetrics + c.stats.EditedMetrics; changed != test.wantChanged {
+			t.Errorf("%s: %d metrics changed, want %d", test.name, changed, test.wantChanged)
+		}
+		if got := c.numFailures(); got != test.wantFailures {
+			t.Errorf("%s: %d failures, want %d", test.name, got, test.wantFailures)
+		}
+
+		f.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+)
+
+// reaperDeactivatedTag marks check bundles deactivated by the reaper so that
+// they can be restored if their target comes back.
+const reaperDeactivatedTag = "circonus-reaper:deactivated"
+
+// modeRestore is the mode recorded for runs of RestoreTargets.
+const modeRestore = "restore"
+
+// reactivateReturningHosts restores check bundles the reaper deactivated whose
+// targets are back in Consul, e.g. a host rebuilt with the same name or the
+// far side of a healed network partition.
+func (c *Reaper) reactivateReturningHosts(ctx context.Context) error {
+	consulHosts, err := c.getConsulHosts(ctx)
+	if err != nil {
+		return errwrap.Wrapf("unable to query Consul hosts: {{err}}", err)
+	}
+
+	inConsul := make(map[string]struct{}, len(consulHosts))
+	for _, host := range consulHosts {
+		inConsul[host] = struct{}{}
+	}
+
+	return c.reactivateTargets(ctx, inConsul, reasonBackInConsul)
+}
+
+// RestoreTargets re-activates the check bundles the reaper deactivated for the
+// given targets right away.  The host inventory isn't consulted: the targets
+// are taken to be back.  Excluded targets are skipped and every change is
+// journaled, as in any other run.
+func (c *Reaper) RestoreTargets(ctx context.Context, targets []string) (*Result, error) {
+	restore := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		restore[target] = struct{}{}
+	}
+
+	return c.runCycle(ctx, modeRestore, func(ctx context.Context) error {
+		if err := c.reactivateTargets(ctx, restore, reasonRequested); err != nil {
+			return errwrap.Wrapf("unable to restore targets: {{err}}", err)
+		}
+
+		return nil
+	})
+}
+
+// reactivateTargets restores the check bundles the reaper deactivated for any
+// of the given targets, reporting reason for each of them.
+func (c *Reaper) reactivateTargets(ctx context.Context, targets map[string]struct{}, reason string) error {
+	filterCriteria := map[string][]string{
+		"f_tags_has": []string{reaperDeactivatedTag},
+	}
+	var checkBundles *[]circonusapi.CheckBundle
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		checkBundles, err = c.circonusClient.SearchCheckBundles(nil, &filterCriteria)
+		return err
+	})
+	c.observeAPICall("SearchCheckBundles", start, err)
+	c.report.addAPICall("SearchCheckBundles", config.CheckBundlePrefix, false, err)
+	if err != nil {
+		return errwrap.Wrapf("unable to search Circonus for deactivated check bundles: {{err}}", err)
+	}
+
+	if checkBundles == nil {
+		return nil
+	}
+
+	reactivated := make(map[string]struct{})
+	for i := range *checkBundles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		checkBundle := &(*checkBundles)[i]
+		if _, found := targets[checkBundle.Target]; !found {
+			continue
+		}
+
+		if c.excludeTarget(checkBundle.Target) {
+			c.log.Info("skipping check bundle re-activation for excluded target", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionSkip)
+			continue
+		}
+
+		if _, found := reactivated[checkBundle.Target]; !found {
+			reactivated[checkBundle.Target] = struct{}{}
+			c.stats.ReactivatedTargets++
+			c.report.addTarget(checkBundle.Target, decisionActivate, reason)
+		}
+
+		if err := c.reactivateCheckBundle(ctx, checkBundle); err != nil {
+			c.log.Error("unable to re-activate check bundle", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "error", err)
+			c.recordFailure(failureKindCheckBundle, checkBundle.CID, err)
+
+			// NOTE(sean@): treat errors as soft because we want to try restoring
+			// check_bundles for all targets vs getting hung up on a single target
+			// that may be failing for some reason.
+			continue
+		}
+	}
+
+	return nil
+}
+
+// reactivateCheckBundle enables a check bundle previously deactivated by the
+// reaper and removes the reaper's tag.
+func (c *Reaper) reactivateCheckBundle(ctx context.Context, checkBundle *circonusapi.CheckBundle) error {
+	log := c.log.With("target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionActivate)
+
+	if c.dryRun {
+		log.Info("dry-run: about to re-activate check bundle")
+		c.report.addAPICall("UpdateCheckBundle", checkBundle.CID, true, nil)
+		return nil
+	}
+
+	ctx, err := c.beginUpdate(ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.journal != nil {
+		if err := c.journal.Record(c.runID, decisionActivate, "check_bundle", checkBundle.CID, checkBundle); err != nil {
+			return errwrap.Wrapf("unable to journal check bundle: {{err}}", err)
+		}
+	}
+
+	updated := *checkBundle
+	updated.Status = "active"
+	updated.Tags = make([]string, 0, len(checkBundle.Tags))
+	for _, tag := range checkBundle.Tags {
+		if tag != reaperDeactivatedTag {
+			updated.Tags = append(updated.Tags, tag)
+		}
+	}
+
+	log.Info("re-activating check bundle")
+	start := time.Now()
+	err = c.updateCall(ctx, func() error {
+		_, err := c.circonusClient.UpdateCheckBundle(&updated)
+		return err
+	})
+	c.observeAPICall("UpdateCheckBundle", start, err)
+	c.report.addAPICall("UpdateCheckBundle", checkBundle.CID, false, err)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to update check bundle %q: {{err}}", checkBundle.CID), err)
+	}
+
+	return nil
+}
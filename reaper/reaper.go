@@ -0,0 +1,853 @@
+package reaper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+var checkBundleCIDRE = regexp.MustCompile(config.CheckBundleCIDRegex)
+
+// Reaper deactivates the Circonus check bundles and metrics of hosts and
+// Nomad allocs that no longer exist.  Every run starts from a fresh inventory,
+// but the check bundle cache is kept from one run to the next.  A Reaper must
+// not be used by more than one goroutine at a time.
+type Reaper struct {
+	mode           string
+	circonusClient *circonusapi.API
+
+	metricQueries []string
+	queryAction   string
+	queryTag      string
+	queryUnits    string
+
+	hosts          HostInventory
+	allocs         AllocInventory
+	excludeRegexps []*regexp.Regexp
+	excludeTargets map[string]bool
+
+	circonusTargetsCache []string
+	consulHostCache      []string
+
+	cache        *bundleCache
+	cacheSynced  bool
+	refreshCache bool
+
+	dryRun          bool
+	prefixSearch    bool
+	deactivateHosts bool
+	reactivateHosts bool
+	targetAction    string
+
+	report    *Report
+	stats     Stats
+	gitCommit string
+
+	metrics        *metrics.Metrics
+	metricsSink    *trapSink
+	metricsTrapURL string
+	apiErrors      *labeledCounter
+
+	// logger is the logger the reaper was configured with and log adds the
+	// current run's ID to it.
+	logger *Logger
+	log    *Logger
+	runID  string
+
+	annotate           bool
+	annotatePerTarget  bool
+	annotationCategory string
+
+	journal       *journal
+	ruleSetPolicy string
+
+	maintenanceScope  string
+	maintenanceWindow time.Duration
+
+	// reapedMetrics maps check CIDs to the names of the metrics deactivated on
+	// them during this run.  A nil set means every metric on the check was
+	// deactivated.
+	reapedMetrics map[string]map[string]struct{}
+
+	// deactivatedTargets maps targets to the names of the metrics deactivated
+	// on them during this run.  Targets whose check bundles were deactivated
+	// are included without metrics.
+	deactivatedTargets map[string][]string
+
+	auditRemoveDatapoints bool
+	livenessCache         map[string]*metricLiveness
+	checkUUIDCache        map[string]string
+
+	state            StateStore
+	clusterEmptyRuns uint
+	clusterPolicy    string
+
+	brokerPolicy      string
+	replacementBroker string
+
+	staleAfter      time.Duration
+	staleMaxMetrics uint
+
+	unknownStatusPolicy string
+
+	requestTimeout time.Duration
+	runTimeout     time.Duration
+
+	// updateCtx bounds the updates of the current run by its deadline.
+	updateCtx context.Context
+
+	// failures collects the errors that were handled softly during this run.
+	failures *multierror.Error
+
+	nomadDefaultPolicy NomadJobPolicy
+
+	// jobPolicyCache maps job IDs to their policies, or to nil if the job is
+	// gone.
+	jobPolicyCache map[string]*NomadJobPolicy
+	allocCache     map[string]*nomadapi.Allocation
+
+	// delayedAllocNodes are the Nomad nodes with allocs kept by a delay
+	// policy, and when the first of them becomes reapable.  They outlive
+	// runs so that Watch can reconcile the nodes again.
+	delayedAllocNodes map[string]time.Time
+
+	metricBudget    uint
+	budgetUsageType string
+	budgetRules     []string
+	budgetTags      []string
+}
+
+func (c *Reaper) deactivateNomadCompletedAllocs(ctx context.Context) error {
+	nomadNameToID, err := c.buildNomadNameIDCache(ctx)
+	if err != nil {
+		return errwrap.Wrapf("unable to populate Nomad Node to ID cache: {{err}}", err)
+	}
+
+	// Without a host inventory every Nomad client is a candidate.
+	var consulHosts []string
+	if c.hosts != nil {
+		consulHosts, err = c.getConsulHosts(ctx)
+		if err != nil {
+			return errwrap.Wrapf("unable to query Consul hosts: {{err}}", err)
+		}
+	} else {
+		consulHosts = make([]string, 0, len(nomadNameToID))
+		for host := range nomadNameToID {
+			consulHosts = append(consulHosts, host)
+		}
+	}
+
+	circonusTargets, err := c.getCirconusTargets(ctx)
+	if err != nil {
+		return errwrap.Wrapf("unable to get Circonus targets: {{err}}", err)
+	}
+
+	consulOnly, circonusOnly, consulAndCirconusHosts := findSets(consulHosts, circonusTargets)
+	_, _, _ = consulOnly, circonusOnly, consulAndCirconusHosts
+
+	// Disable all metrics associated with an inactive Nomad allocation.  Search
+	// domain is limited to hosts that are in both Circonus and Consul (or
+	// Nomad, without a host inventory).
+	for _, host := range consulAndCirconusHosts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var nodeID string
+		if id, found := nomadNameToID[host]; found {
+			nodeID = id
+		} else {
+			c.log.Info("ignoring non-nomad client", "target", host, "action", decisionSkip)
+			c.report.addTarget(host, decisionSkip, reasonNonNomadClient)
+			continue
+		}
+
+		if c.excludeTarget(host) {
+			c.log.Info("skipping excluded nomad client", "target", host, "action", decisionSkip)
+			c.report.addTarget(host, decisionSkip, reasonExcluded)
+			continue
+		}
+
+		if err := c.reconcileNomadAllocs(ctx, host, nodeID); err != nil {
+			c.log.Error("unable to reconcile nomad allocs", "target", host, "error", err)
+			c.recordFailure(failureKindTarget, host, err)
+			continue
+		}
+	}
+
+	return nil
+}
+
+func (c *Reaper) deactivateUnknownHosts(ctx context.Context) error {
+	consulHosts, err := c.getConsulHosts(ctx)
+	if err != nil {
+		return errwrap.Wrapf("unable to query Consul hosts: {{err}}", err)
+	}
+
+	circonusTargets, err := c.getCirconusTargets(ctx)
+	if err != nil {
+		return errwrap.Wrapf("unable to get Circonus targets: {{err}}", err)
+	}
+
+	consulOnly, circonusOnly, consulAndCirconusHosts := findSets(consulHosts, circonusTargets)
+	_, _, _ = consulOnly, circonusOnly, consulAndCirconusHosts
+
+	return c.deactivateTargets(ctx, circonusOnly)
+}
+
+// deactivateTargets deactivates the check bundles of every given target that
+// isn't excluded.  The targets are only reported unless host deactivation is
+// enabled.
+func (c *Reaper) deactivateTargets(ctx context.Context, targets []string) error {
+	if !c.deactivateHosts {
+		for _, host := range targets {
+			c.log.Debug("skipping check bundle deactivation for target not in consul", "target", host, "action", decisionSkip)
+			c.report.addTarget(host, decisionSkip, reasonDeactivationDisabled)
+		}
+		if len(targets) > 0 {
+			c.log.Info("host deactivation is disabled, leaving the check bundles of targets not in consul alone", "targets", len(targets))
+		}
+		return nil
+	}
+
+	return c.reapTargets(ctx, targets, TargetActionDeactivate, reasonNotInConsul)
+}
+
+// reapTargets deactivates or deletes, according to action, the check bundles
+// of every given target that isn't excluded.  A target is only counted, and
+// reported, once at least one of its check bundles was changed.
+func (c *Reaper) reapTargets(ctx context.Context, targets []string, action, reason string) error {
+	for _, host := range targets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if c.excludeTarget(host) {
+			c.log.Info("skipping check bundle deactivation for excluded target", "target", host, "action", decisionSkip)
+			c.report.addTarget(host, decisionSkip, reasonExcluded)
+			c.stats.ExcludedTargets++
+			continue
+		}
+
+		n, err := c.disableTargetChecks(ctx, host, action)
+		if n > 0 {
+			switch action {
+			case TargetActionDelete:
+				c.report.addTarget(host, decisionDelete, reason)
+				c.stats.DeletedTargets++
+			default:
+				c.report.addTarget(host, decisionDeactivate, reason)
+				c.stats.DisabledTargets++
+				if _, found := c.deactivatedTargets[host]; !found {
+					c.deactivatedTargets[host] = nil
+				}
+			}
+		}
+		if err != nil {
+			c.log.Error("unable to disable checks on target", "target", host, "error", err)
+			c.recordFailure(failureKindTarget, host, err)
+
+			// NOTE(sean@): treat errors as soft because we want to try deactivating
+			// check_bundles for all targets vs getting hung up on a single target
+			// that may be failing for some reason.
+			continue
+		}
+
+		if n == 0 {
+			c.log.Debug("no active check bundles to reap on target", "target", host)
+		}
+	}
+
+	return nil
+}
+
+// deactivateCheckBundle disables the check bundle and tags it so that it can be
+// re-activated if its target comes back.
+func (c *Reaper) deactivateCheckBundle(ctx context.Context, checkBundle *circonusapi.CheckBundle) error {
+	if c.journal != nil {
+		if err := c.journal.Record(c.runID, decisionDeactivate, "check_bundle", checkBundle.CID, checkBundle); err != nil {
+			return errwrap.Wrapf("unable to journal check bundle: {{err}}", err)
+		}
+	}
+
+	updated := *checkBundle
+	updated.Status = "disabled"
+	updated.Tags = append([]string{}, checkBundle.Tags...)
+	if !containsString(updated.Tags, reaperDeactivatedTag) {
+		updated.Tags = append(updated.Tags, reaperDeactivatedTag)
+	}
+
+	start := time.Now()
+	err := c.updateCall(ctx, func() error {
+		_, err := c.circonusClient.UpdateCheckBundle(&updated)
+		return err
+	})
+	c.observeAPICall("UpdateCheckBundle", start, err)
+
+	return err
+}
+
+// disableTargetChecks deactivates or deletes, according to action, the active
+// check bundles of target that aren't excluded and returns how many it
+// changed.  The count covers the bundles changed before an error, if any.
+func (c *Reaper) disableTargetChecks(ctx context.Context, target, action string) (uint, error) {
+	checkBundles, err := c.findCheckBundlesByTarget(ctx, target)
+	if err != nil {
+		return 0, errwrap.Wrapf(fmt.Sprintf("unable to find checks for target %q: {{err}}", target), err)
+	}
+
+	var n uint
+	for _, checkBundle := range checkBundles {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		if c.excludeTarget(checkBundle.Target) {
+			c.log.Info("skipping excluded check bundle", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionSkip)
+			continue
+		}
+
+		if c.dryRun {
+			switch action {
+			case TargetActionDelete:
+				c.log.Info("dry-run: about to delete check bundle", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionDelete)
+				c.report.addAPICall("DeleteCheckBundle", checkBundle.CID, true, nil)
+			default:
+				c.log.Info("dry-run: about to deactivate check bundle", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionDeactivate)
+				c.report.addAPICall("UpdateCheckBundle", checkBundle.CID, true, nil)
+			}
+			c.recordReapedCheckBundle(checkBundle)
+			n++
+			continue
+		}
+
+		updateCtx, err := c.beginUpdate(ctx)
+		if err != nil {
+			return n, err
+		}
+
+		if action == TargetActionDelete {
+			c.log.Info("about to delete check bundle", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionDelete)
+			err = c.withMaintenance(updateCtx, target, checkBundle.Checks, func() error {
+				return c.deleteCheckBundle(updateCtx, checkBundle)
+			})
+			if err != nil {
+				return n, errwrap.Wrapf(fmt.Sprintf("unable to delete check bundle %q: {{err}}", checkBundle.CID), err)
+			}
+			c.recordReapedCheckBundle(checkBundle)
+			n++
+			continue
+		}
+
+		c.log.Info("about to deactivate check bundle", "target", checkBundle.Target, "check_bundle_cid", checkBundle.CID, "action", decisionDeactivate)
+		err = c.withMaintenance(updateCtx, target, checkBundle.Checks, func() error {
+			err := c.deactivateCheckBundle(updateCtx, checkBundle)
+			c.report.addAPICall("UpdateCheckBundle", checkBundle.CID, false, err)
+			return err
+		})
+		if err != nil {
+			return n, errwrap.Wrapf(fmt.Sprintf("unable to deactivate check bundle %q: {{err}}", checkBundle.CID), err)
+		}
+		c.recordReapedCheckBundle(checkBundle)
+		n++
+	}
+
+	return n, nil
+}
+
+func (c *Reaper) excludeTarget(host string) bool {
+	_, found := c.excludeTargets[host]
+	if found {
+		return true
+	}
+
+	for _, re := range c.excludeRegexps {
+		if b := re.MatchString(host); b {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findAllocsByNodeID returns the allocs on a Nomad client, keyed by alloc ID.
+func (c *Reaper) findAllocsByNodeID(ctx context.Context, nodeID string) (map[string]*nomadapi.Allocation, error) {
+	var allocs map[string]*nomadapi.Allocation
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		allocs, err = c.allocs.NodeAllocs(ctx, nodeID)
+		return err
+	})
+	c.observeAPICall("NomadNodeAllocations", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return allocs, nil
+}
+
+func (c *Reaper) findCheckBundlesByTarget(ctx context.Context, host string) ([]*circonusapi.CheckBundle, error) {
+	if c.cache != nil {
+		return c.cachedCheckBundlesByTarget(ctx, host)
+	}
+
+	v := url.Values{}
+
+	if c.prefixSearch {
+		host = fmt.Sprintf("%s%s", host, "*")
+	}
+	v.Set("search", fmt.Sprintf("(active:1)(host:%q)", host))
+
+	v.Set("size", "1000")
+
+	u := url.URL{}
+	u.Path = config.CheckBundlePrefix
+	u.RawQuery = v.Encode()
+
+	var respJSON []byte
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		respJSON, err = c.circonusClient.Get(u.String())
+		return err
+	})
+	c.observeAPICall("SearchCheckBundlesByTarget", start, err)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to fetch search results: {{err}}", err)
+	}
+
+	checkBundles := []*circonusapi.CheckBundle{}
+
+	err = json.Unmarshal(respJSON, &checkBundles)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to decode response: {{err}}", err)
+	}
+
+	return checkBundles, nil
+}
+
+func (c *Reaper) getCirconusTargets(ctx context.Context) ([]string, error) {
+	if c.circonusTargetsCache != nil {
+		return c.circonusTargetsCache, nil
+	}
+
+	if c.cache != nil {
+		hosts, err := c.cachedCirconusTargets(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.circonusTargetsCache = hosts
+		c.stats.CirconusTargets = uint(len(hosts))
+
+		return c.circonusTargetsCache, nil
+	}
+
+	searchQuery := circonusapi.SearchQueryType("(active:1)")
+	filterCriteria := map[string][]string{
+	/* "available": nil, */
+	}
+	var checkBundles *[]circonusapi.CheckBundle
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		checkBundles, err = c.circonusClient.SearchCheckBundles(&searchQuery, &filterCriteria)
+		return err
+	})
+	c.observeAPICall("SearchCheckBundles", start, err)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to search Circonus: {{err}}", err)
+	}
+
+	var hosts []string
+	if checkBundles != nil {
+		hosts = make([]string, 0, len(*checkBundles))
+
+		hostMap := make(map[string]struct{}, len(*checkBundles))
+		for _, checkBundle := range *checkBundles {
+			hostMap[checkBundle.Target] = struct{}{}
+		}
+
+		for host := range hostMap {
+			hosts = append(hosts, host)
+		}
+
+		c.circonusTargetsCache = hosts
+		c.stats.CirconusTargets = uint(len(hosts))
+	}
+
+	return c.circonusTargetsCache, nil
+}
+
+func (c *Reaper) getCirconusTargetMetrics(ctx context.Context, target string) ([]string, error) {
+	searchQuery := circonusapi.SearchQueryType(fmt.Sprintf("(host:%q)(active:1)", target))
+	filter := circonusapi.SearchFilterType(nil)
+
+	var metrics *[]circonusapi.Metric
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		metrics, err = c.circonusClient.SearchMetrics(&searchQuery, &filter)
+		return err
+	})
+	c.observeAPICall("SearchMetrics", start, err)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to search for target metrics: {{err}}", err)
+	}
+
+	var metricCIDs []string
+	if metrics != nil {
+		metricCIDs = make([]string, 0, len(*metrics))
+		for _, metric := range *metrics {
+			metricCIDs = append(metricCIDs, metric.CID)
+		}
+	}
+
+	return metricCIDs, nil
+}
+
+func (c *Reaper) getConsulHosts(ctx context.Context) ([]string, error) {
+	if c.consulHostCache != nil {
+		return c.consulHostCache, nil
+	}
+
+	var hosts []string
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		hosts, err = c.hosts.Hosts(ctx)
+		return err
+	})
+	c.observeAPICall("ConsulCatalogNodes", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	c.consulHostCache = hosts
+	c.stats.Hosts = uint(len(hosts))
+
+	return c.consulHostCache, nil
+}
+
+// fetchCheckBundleMetrics fetches the metrics and their statuses for the given
+// check bundle CID.
+func (c *Reaper) fetchCheckBundleMetrics(ctx context.Context, checkBundleCID string) (*circonusapi.CheckBundleMetrics, error) {
+	checkBundleMD := checkBundleCIDRE.FindStringSubmatch(checkBundleCID)
+	if checkBundleMD == nil || len(checkBundleMD) < 3 {
+		return nil, fmt.Errorf("unable to extract CID from %q", checkBundleCID)
+	}
+	checkBundleID := checkBundleMD[2]
+
+	checkBundleMetricIDStr := fmt.Sprintf("%s/%s", config.CheckBundleMetricsPrefix, checkBundleID)
+	var cbm *circonusapi.CheckBundleMetrics
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		cbm, err = c.circonusClient.FetchCheckBundleMetrics(circonusapi.CIDType(&checkBundleMetricIDStr))
+		return err
+	})
+	c.observeAPICall("FetchCheckBundleMetrics", start, err)
+	c.report.addAPICall("FetchCheckBundleMetrics", checkBundleMetricIDStr, false, err)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to fetch check bundle metrics %q: {{err}}", checkBundleMetricIDStr), err)
+	}
+
+	return cbm, nil
+}
+
+// updateCheckBundleMetrics pushes the metric statuses in cbm back to Circonus
+// inside a maintenance window covering the bundle's checks.  Nothing is
+// changed during a dry run.
+func (c *Reaper) updateCheckBundleMetrics(ctx context.Context, target, checkBundleCID string, checkCIDs []string, cbm *circonusapi.CheckBundleMetrics) error {
+	if c.dryRun {
+		c.log.Info("dry-run: about to update check bundle metrics", "target", target, "check_bundle_cid", checkBundleCID)
+		c.report.addAPICall("UpdateCheckBundleMetrics", cbm.CID, true, nil)
+		return nil
+	}
+
+	c.log.Info("about to update check bundle metrics", "target", target, "check_bundle_cid", checkBundleCID)
+
+	ctx, err := c.beginUpdate(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.withMaintenance(ctx, target, checkCIDs, func() error {
+		start := time.Now()
+		err := c.updateCall(ctx, func() error {
+			_, err := c.circonusClient.UpdateCheckBundleMetrics(cbm)
+			return err
+		})
+		c.observeAPICall("UpdateCheckBundleMetrics", start, err)
+		c.report.addAPICall("UpdateCheckBundleMetrics", cbm.CID, false, err)
+		switch {
+		case err == nil:
+			c.invalidateCachedMetrics(checkBundleCID)
+		case isNotFound(err):
+			c.evictCachedCheckBundle(checkBundleCID)
+		}
+		return err
+	})
+}
+
+// reconcileNomadAllocs activates the metrics of the live allocs on a single
+// Nomad client and deactivates the metrics of allocs that are no longer on it.
+func (c *Reaper) reconcileNomadAllocs(ctx context.Context, host, nodeID string) error {
+	// Pull the nomad allocs for a given target
+	c.log.Trace("searching nomad client", "target", host)
+	allocs, err := c.findAllocsByNodeID(ctx, nodeID)
+	if err != nil {
+		return errwrap.Wrapf("unable to find allocs for nomad client: {{err}}", err)
+	}
+	c.stats.LiveAllocs += uint(len(allocs))
+
+	checkBundles, err := c.findCheckBundlesByTarget(ctx, host)
+	if err != nil {
+		return errwrap.Wrapf("unable to find checks for target: {{err}}", err)
+	}
+
+	// nomad`<host>`client`allocs`...`<alloc>`..., usually
+	// nomad`<host>`client`allocs`<job>`<group>`<alloc>`<task>`<metric>
+	nomadAllocRE := regexp.MustCompile(fmt.Sprintf("(?i)^nomad`%s`client`allocs`(.*)`%s`", regexp.QuoteMeta(host), `([\da-f]{8}-[\da-f]{4}-[\da-f]{4}-[\da-f]{4}-[\da-f]{12})`))
+
+	for _, checkBundle := range checkBundles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cbm, err := c.cachedCheckBundleMetrics(ctx, checkBundle)
+		if err != nil {
+			c.log.Error("unable to fetch check bundle metrics", "target", host, "check_bundle_cid", checkBundle.CID, "error", err)
+			c.recordFailure(failureKindCheckBundle, checkBundle.CID, err)
+			continue
+		}
+
+		if cbm != nil {
+			var dirtyCheckBundle bool
+
+			// Deactivated metrics are only recorded for rule set reconciliation
+			// once the update has gone through.
+			var reaped []string
+
+			for i := range cbm.Metrics {
+				allocMD := nomadAllocRE.FindStringSubmatch(cbm.Metrics[i].Name)
+				if allocMD == nil || len(allocMD) < 3 {
+					continue
+				}
+				allocID := strings.ToLower(allocMD[2])
+				jobID, group, task := nomadAllocMetricParts(allocMD[1], cbm.Metrics[i].Name[len(allocMD[0]):])
+
+				status, ok := c.metricStatusOf(host, checkBundle.CID, &cbm.Metrics[i])
+				if !ok {
+					continue
+				}
+
+				// alloc ID is active on the nomad client but no longer runs the task
+				if alloc, found := allocs[allocID]; found && allocTaskRemoved(alloc, jobID, group, task) {
+					c.stats.RemovedNomadTaskMetrics++
+					switch status {
+					case metricStatusActive:
+						// The job's policy applies to removed tasks as it does
+						// to finished allocs.
+						reapable, reason, err := c.allocReapable(ctx, jobID, allocID)
+						if err != nil {
+							c.log.Error("unable to look up job policy, keeping metric", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "alloc_id", allocID, "error", err)
+							c.recordFailure(failureKindAlloc, allocID, err)
+							continue
+						}
+						if !reapable {
+							c.log.Debug("keeping metric per job policy", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "job", jobID, "task", task, "reason", reason, "action", decisionSkip)
+							c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionSkip, reason)
+							continue
+						}
+
+						c.log.Info("toggling metric to available", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "task", task, "action", decisionDeactivate)
+						c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionDeactivate, reasonRemovedTask)
+						reaped = append(reaped, cbm.Metrics[i].Name)
+						cbm.Metrics[i].Status = string(metricStatusAvailable)
+						dirtyCheckBundle = true
+						c.stats.DisabledMetrics++
+					case metricStatusAvailable:
+						c.log.Trace("skipping metric", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "action", decisionSkip)
+						c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionSkip, reasonAlreadyAvailable)
+					}
+					continue
+				}
+
+				// alloc ID is active on the nomad client
+				if _, found := allocs[allocID]; found {
+					c.stats.ActiveNomadAllocMetrics++
+					switch status {
+					case metricStatusActive:
+						c.log.Trace("skipping metric", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "action", decisionSkip)
+						c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionSkip, reasonAlreadyActive)
+					case metricStatusAvailable:
+						c.log.Info("toggling metric to active", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "action", decisionActivate)
+						c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionActivate, reasonLiveAlloc)
+						dirtyCheckBundle = true
+						cbm.Metrics[i].Status = string(metricStatusActive)
+						c.stats.EnabledMetrics++
+					}
+					continue
+				}
+
+				// alloc ID is no longer active on the nomad client but its metrics are
+				c.stats.AvailableNomadAllocMetrics++
+				switch status {
+				case metricStatusActive:
+					reapable, reason, err := c.allocReapable(ctx, jobID, allocID)
+					if err != nil {
+						c.log.Error("unable to look up job policy, keeping metric", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "alloc_id", allocID, "error", err)
+						c.recordFailure(failureKindAlloc, allocID, err)
+						continue
+					}
+					if !reapable {
+						c.log.Debug("keeping metric per job policy", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "job", jobID, "reason", reason, "action", decisionSkip)
+						c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionSkip, reason)
+						continue
+					}
+
+					c.log.Info("toggling metric to available", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "action", decisionDeactivate)
+					c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionDeactivate, reasonOrphanedAlloc)
+					reaped = append(reaped, cbm.Metrics[i].Name)
+					cbm.Metrics[i].Status = string(metricStatusAvailable)
+					dirtyCheckBundle = true
+					c.stats.DisabledMetrics++
+				case metricStatusAvailable:
+					c.log.Trace("skipping metric", "target", host, "check_bundle_cid", checkBundle.CID, "metric", cbm.Metrics[i].Name, "action", decisionSkip)
+					c.report.addMetric(host, checkBundle.CID, cbm.Metrics[i].Name, cbm.Metrics[i].Status, decisionSkip, reasonAlreadyAvailable)
+				}
+			}
+
+			// Update the checkbundle metrics
+			if dirtyCheckBundle {
+				if err := c.updateCheckBundleMetrics(ctx, host, checkBundle.CID, checkBundle.Checks, cbm); err != nil {
+					c.log.Error("unable to update check bundle metrics", "target", host, "check_bundle_cid", checkBundle.CID, "error", err)
+					c.recordFailure(failureKindCheckBundle, checkBundle.CID, err)
+
+					// NOTE(sean@): treat errors as soft because we want to try updating
+					// check_bundle_metrics for all targets vs getting hung up on a
+					// single target that may be failing for some reason.
+					continue
+				}
+
+				for _, metric := range reaped {
+					c.recordReapedMetric(host, checkBundle.Checks, metric)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// nomadAllocMetricParts returns the job, group and task of a Nomad alloc
+// metric from the components before its alloc ID, <job>`<group>, and after
+// it, <task>`<metric>.  The group and task are empty if the metric isn't
+// shaped that way.
+func nomadAllocMetricParts(before, after string) (job, group, task string) {
+	parts := strings.Split(before, "`")
+	job = parts[0]
+	if len(parts) != 2 {
+		return job, "", ""
+	}
+	group = parts[1]
+
+	if i := strings.Index(after, "`"); i > 0 {
+		task = after[:i]
+	}
+
+	return job, group, task
+}
+
+// allocTaskRemoved returns true if a metric reported for the given job, group
+// and task belongs to the alloc but the alloc no longer runs the task, e.g.
+// because the job was updated in place to remove it.
+func allocTaskRemoved(alloc *nomadapi.Allocation, jobID, group, task string) bool {
+	// An alloc that hasn't started any tasks yet has nothing to check against,
+	// and a metric without a group and task can't name a removed task.
+	if len(alloc.TaskStates) == 0 || group == "" || task == "" {
+		return false
+	}
+
+	if nomadMetricComponent(alloc.JobID) != nomadMetricComponent(jobID) ||
+		nomadMetricComponent(alloc.TaskGroup) != nomadMetricComponent(group) {
+		return false
+	}
+
+	for name := range alloc.TaskStates {
+		if nomadMetricComponent(name) == nomadMetricComponent(task) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nomadMetricComponent returns a Nomad name the way it appears as a component
+// of a metric name: the Circonus sink replaces spaces with underscores and
+// metric names are matched case insensitively.
+func nomadMetricComponent(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "_", -1))
+}
+
+func (c *Reaper) buildNomadNameIDCache(ctx context.Context) (map[string]string, error) {
+	var nodeCache map[string]string
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		nodeCache, err = c.allocs.Nodes(ctx)
+		return err
+	})
+	c.observeAPICall("NomadNodesList", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stats.NomadClients = uint(len(nodeCache))
+
+	return nodeCache, nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func findSets(a, b []string) (aOnly, bOnly, union []string) {
+	vals := make(map[string]byte, len(a)+len(b))
+
+	for _, v := range a {
+		vals[v] = 'a'
+	}
+
+	for _, v := range b {
+		if _, found := vals[v]; found {
+			vals[v] = 'u'
+		} else {
+			vals[v] = 'b'
+		}
+	}
+
+	mapToSlice := func(m map[string]byte, selector byte) []string {
+		l := make([]string, 0, len(m))
+		for k, v := range m {
+			if v == selector || selector == 'u' {
+				l = append(l, k)
+			}
+		}
+		return l
+	}
+
+	return mapToSlice(vals, 'a'), mapToSlice(vals, 'b'), mapToSlice(vals, 'u')
+}
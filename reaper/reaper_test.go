@@ -0,0 +1,355 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+func TestNomadAllocMetricParts(t *testing.T) {
+	tests := []struct {
+		before, after                string
+		wantJob, wantGroup, wantTask string
+	}{
+		{before: "web", after: "", wantJob: "web"},
+		{before: "web`frontend", after: "nginx`memory`rss", wantJob: "web", wantGroup: "frontend", wantTask: "nginx"},
+		{before: "web`frontend", after: "memory", wantJob: "web", wantGroup: "frontend"},
+		{before: "web`frontend", after: "`memory", wantJob: "web", wantGroup: "frontend"},
+		{before: "a`b`c", after: "nginx`memory", wantJob: "a"},
+	}
+
+	for _, test := range tests {
+		job, group, task := nomadAllocMetricParts(test.before, test.after)
+		if job != test.wantJob || group != test.wantGroup || task != test.wantTask {
+			t.Errorf("nomadAllocMetricParts(%q, %q) = %q, %q, %q, want %q, %q, %q",
+				test.before, test.after, job, group, task, test.wantJob, test.wantGroup, test.wantTask)
+		}
+	}
+}
+
+func TestAllocTaskRemoved(t *testing.T) {
+	alloc := &nomadapi.Allocation{
+		JobID:     "web",
+		TaskGroup: "front end",
+		TaskStates: map[string]*nomadapi.TaskState{
+			"nginx":       {},
+			"Log Shipper": {},
+		},
+	}
+
+	tests := []struct {
+		name             string
+		alloc            *nomadapi.Allocation
+		job, group, task string
+		want             bool
+	}{
+		{name: "running task", alloc: alloc, job: "web", group: "front_end", task: "nginx"},
+		{name: "running task with spaces", alloc: alloc, job: "WEB", group: "FRONT_END", task: "log_shipper"},
+		{name: "removed task", alloc: alloc, job: "web", group: "front_end", task: "varnish", want: true},
+		{name: "other job", alloc: alloc, job: "api", group: "front_end", task: "varnish"},
+		{name: "other group", alloc: alloc, job: "web", group: "back_end", task: "varnish"},
+		{name: "no group or task", alloc: alloc, job: "web"},
+		{name: "no task", alloc: alloc, job: "web", group: "front_end"},
+		{name: "no task states", alloc: &nomadapi.Allocation{JobID: "web", TaskGroup: "front end"}, job: "web", group: "front_end", task: "varnish"},
+	}
+
+	for _, test := range tests {
+		if got := allocTaskRemoved(test.alloc, test.job, test.group, test.task); got != test.want {
+			t.Errorf("%s: allocTaskRemoved(%q, %q, %q) = %v, want %v", test.name, test.job, test.group, test.task, got, test.want)
+		}
+	}
+}
+
+func TestDisableTargetChecksSkipsExcludedBundles(t *testing.T) {
+	tests := []struct {
+		name            string
+		excludeTargets  []string
+		wantDeactivated []string
+		wantActive      []string
+	}{
+		{
+			name:            "excluded bundle before a reapable one",
+			excludeTargets:  []string{"web1-canary"},
+			wantDeactivated: []string{"/check_bundle/2"},
+			wantActive:      []string{"/check_bundle/1"},
+		},
+		{
+			name:            "excluded bundle after a reapable one",
+			excludeTargets:  []string{"web1"},
+			wantDeactivated: []string{"/check_bundle/1"},
+			wantActive:      []string{"/check_bundle/2"},
+		},
+		{
+			name:            "nothing excluded",
+			wantDeactivated: []string{"/check_bundle/1", "/check_bundle/2"},
+		},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1-canary", "cpu")
+		f.addCheckBundle(2, "web1", "cpu")
+
+		c := newTestReaper(t, f, Config{PrefixSearch: true, ExcludeTargets: test.excludeTargets})
+		if _, err := c.disableTargetChecks(context.Background(), "web1", TargetActionDeactivate); err != nil {
+			t.Errorf("%s: disableTargetChecks() = %v", test.name, err)
+		}
+
+		for _, cid := range test.wantDeactivated {
+			if checkBundle := f.checkBundle(cid); checkBundle.Status != "disabled" || !containsString(checkBundle.Tags, reaperDeactivatedTag) {
+				t.Errorf("%s: %s has status %q and tags %q, want it deactivated", test.name, cid, checkBundle.Status, checkBundle.Tags)
+			}
+		}
+		for _, cid := range test.wantActive {
+			if checkBundle := f.checkBundle(cid); checkBundle.Status != "active" {
+				t.Errorf("%s: %s has status %q, want active", test.name, cid, checkBundle.Status)
+			}
+		}
+
+		f.Close()
+	}
+}
+
+func TestReapTargetsCounting(t *testing.T) {
+	tests := []struct {
+		name            string
+		target          string
+		action          string
+		dryRun          bool
+		excludeTargets  []string
+		fail            map[string]int
+		wantDisabled    uint
+		wantDeleted     uint
+		wantDecision    string
+		wantDeactivated bool
+		wantFailures    int
+		wantRemaining   []string
+	}{
+		{
+			name:          "no check bundles",
+			target:        "db1",
+			action:        TargetActionDeactivate,
+			wantRemaining: []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+		},
+		{
+			name:           "only excluded check bundles",
+			target:         "web1-",
+			action:         TargetActionDeactivate,
+			excludeTargets: []string{"web1-canary"},
+			wantRemaining:  []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+		},
+		{
+			name:            "excluded check bundle before a reapable one",
+			target:          "web1",
+			action:          TargetActionDeactivate,
+			excludeTargets:  []string{"web1-canary"},
+			wantDisabled:    1,
+			wantDecision:    decisionDeactivate,
+			wantDeactivated: true,
+			wantRemaining:   []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+		},
+		{
+			name:           "delete",
+			target:         "web1",
+			action:         TargetActionDelete,
+			excludeTargets: []string{"web1-canary"},
+			wantDeleted:    1,
+			wantDecision:   decisionDelete,
+			wantRemaining:  []string{"/check_bundle/1", "/check_bundle/3"},
+		},
+		{
+			name:          "dry run",
+			target:        "web1",
+			action:        TargetActionDelete,
+			dryRun:        true,
+			wantDeleted:   1,
+			wantDecision:  decisionDelete,
+			wantRemaining: []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+		},
+		{
+			name:            "failed update after a successful one",
+			target:          "web1",
+			action:          TargetActionDeactivate,
+			fail:            map[string]int{"PUT /check_bundle/2": 403},
+			wantDisabled:    1,
+			wantDecision:    decisionDeactivate,
+			wantDeactivated: true,
+			wantFailures:    1,
+			wantRemaining:   []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+		},
+		{
+			name:          "failed first update",
+			target:        "web1",
+			action:        TargetActionDeactivate,
+			fail:          map[string]int{"PUT /check_bundle/1": 403},
+			wantFailures:  1,
+			wantRemaining: []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+		},
+		{
+			name:          "failed search",
+			target:        "web1",
+			action:        TargetActionDeactivate,
+			fail:          map[string]int{"GET /check_bundle": 403},
+			wantFailures:  1,
+			wantRemaining: []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"},
+		},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1-canary", "cpu")
+		f.addCheckBundle(2, "web1", "cpu")
+		f.addCheckBundle(3, "web2", "cpu")
+		for req, code := range test.fail {
+			f.fail[req] = code
+		}
+
+		c := newTestReaper(t, f, Config{DryRun: test.dryRun, ExcludeTargets: test.excludeTargets, PrefixSearch: true})
+		if err := c.reapTargets(context.Background(), []string{test.target}, test.action, reasonRequested); err != nil {
+			t.Errorf("%s: reapTargets() = %v", test.name, err)
+		}
+
+		if c.stats.DisabledTargets != test.wantDisabled || c.stats.DeletedTargets != test.wantDeleted {
+			t.Errorf("%s: disabled %d and deleted %d targets, want %d and %d", test.name, c.stats.DisabledTargets, c.stats.DeletedTargets, test.wantDisabled, test.wantDeleted)
+		}
+
+		var decision string
+		if len(c.report.Targets) > 0 {
+			decision = c.report.Targets[0].Decision
+		}
+		if len(c.report.Targets) > 1 || decision != test.wantDecision {
+			t.Errorf("%s: reported targets %+v, want a single %q", test.name, c.report.Targets, test.wantDecision)
+		}
+
+		if _, found := c.deactivatedTargets[test.target]; found != test.wantDeactivated {
+			t.Errorf("%s: target recorded as deactivated = %v, want %v", test.name, found, test.wantDeactivated)
+		}
+
+		if got := c.numFailures(); got != test.wantFailures {
+			t.Errorf("%s: %d failures, want %d", test.name, got, test.wantFailures)
+		}
+
+		var remaining []string
+		for _, cid := range []string{"/check_bundle/1", "/check_bundle/2", "/check_bundle/3"} {
+			if f.checkBundle(cid) != nil {
+				remaining = append(remaining, cid)
+			}
+		}
+		if !reflect.DeepEqual(remaining, test.wantRemaining) {
+			t.Errorf("%s: remaining check bundles %q, want %q", test.name, remaining, test.wantRemaining)
+		}
+
+		f.Close()
+	}
+}
+
+func TestDeactivateTargets(t *testing.T) {
+	tests := []struct {
+		name            string
+		deactivateHosts bool
+		wantStatus      string
+		wantDecision    string
+		wantReason      string
+	}{
+		{name: "deactivation disabled", wantStatus: "active", wantDecision: decisionSkip, wantReason: reasonDeactivationDisabled},
+		{name: "deactivation enabled", deactivateHosts: true, wantStatus: "disabled", wantDecision: decisionDeactivate, wantReason: reasonNotInConsul},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1", "cpu")
+
+		c := newTestReaper(t, f, Config{DeactivateHosts: test.deactivateHosts})
+		if err := c.deactivateTargets(context.Background(), []string{"web1"}); err != nil {
+			t.Errorf("%s: deactivateTargets() = %v", test.name, err)
+		}
+
+		if status := f.checkBundle("/check_bundle/1").Status; status != test.wantStatus {
+			t.Errorf("%s: check bundle status %q, want %q", test.name, status, test.wantStatus)
+		}
+		want := []ReportTarget{{Target: "web1", Decision: test.wantDecision, Reason: test.wantReason}}
+		if !reflect.DeepEqual(c.report.Targets, want) {
+			t.Errorf("%s: reported targets %+v, want %+v", test.name, c.report.Targets, want)
+		}
+
+		f.Close()
+	}
+}
+
+func TestReconcileNomadAllocsRemovedTaskPolicy(t *testing.T) {
+	const (
+		allocID     = "0123abcd-0123-4567-89ab-0123456789ab"
+		runningTask = "nomad`web1`client`allocs`web`frontend`" + allocID + "`nginx`memory`rss"
+		removedTask = "nomad`web1`client`allocs`web`frontend`" + allocID + "`varnish`memory`rss"
+		checkBundle = "/check_bundle/1"
+	)
+
+	tests := []struct {
+		name         string
+		jobMeta      map[string]string
+		jobErr       error
+		wantStatus   string
+		wantReason   string
+		wantFailures int
+	}{
+		{name: "default policy", wantStatus: "available", wantReason: reasonRemovedTask},
+		{name: "keep", jobMeta: map[string]string{nomadPolicyMetaKey: NomadPolicyKeep}, wantStatus: "active", wantReason: reasonJobPolicyKeep},
+		{name: "delay not yet passed", jobMeta: map[string]string{nomadPolicyMetaKey: "delay:1h"}, wantStatus: "active", wantReason: reasonJobPolicyDelay},
+		{name: "delay passed", jobMeta: map[string]string{nomadPolicyMetaKey: "delay:1m"}, wantStatus: "available", wantReason: reasonRemovedTask},
+		{name: "job lookup fails", jobErr: errors.New("connection refused"), wantStatus: "active", wantFailures: 1},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1", runningTask, removedTask)
+
+		inv := &fakeAllocInventory{
+			allocs: map[string]*nomadapi.Allocation{
+				allocID: {
+					ID:        allocID,
+					NodeID:    "node-1",
+					JobID:     "web",
+					TaskGroup: "frontend",
+					TaskStates: map[string]*nomadapi.TaskState{
+						"nginx": {Events: []*nomadapi.TaskEvent{{Time: time.Now().Add(-10 * time.Minute).UnixNano()}}},
+					},
+				},
+			},
+			jobMeta: map[string]map[string]string{"web": test.jobMeta},
+			jobErr:  test.jobErr,
+		}
+
+		c := newTestReaper(t, f, Config{Allocs: inv})
+		if err := c.reconcileNomadAllocs(context.Background(), "web1", "node-1"); err != nil {
+			t.Errorf("%s: reconcileNomadAllocs() = %v", test.name, err)
+		}
+
+		statuses := f.metricStatuses(checkBundle)
+		if statuses[runningTask] != "active" {
+			t.Errorf("%s: running task metric is %q, want active", test.name, statuses[runningTask])
+		}
+		if statuses[removedTask] != test.wantStatus {
+			t.Errorf("%s: removed task metric is %q, want %q", test.name, statuses[removedTask], test.wantStatus)
+		}
+
+		var reason string
+		for _, metric := range c.report.Metrics {
+			if metric.Metric == removedTask {
+				reason = metric.Reason
+			}
+		}
+		if reason != test.wantReason {
+			t.Errorf("%s: removed task metric reported with reason %q, want %q", test.name, reason, test.wantReason)
+		}
+
+		if got := c.numFailures(); got != test.wantFailures {
+			t.Errorf("%s: %d failures, want %d", test.name, got, test.wantFailures)
+		}
+
+		f.Close()
+	}
+}
@@ -0,0 +1,344 @@
+package reaper
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Decisions recorded against every target or metric the reaper considers.
+const (
+	decisionActivate   = "activate"
+	decisionDeactivate = "deactivate"
+	decisionDelete     = "delete"
+	decisionSkip       = "skip"
+)
+
+// Reasons explaining why a decision was made.
+const (
+	reasonAlreadyActive        = "already active"
+	reasonAlreadyAvailable     = "already available"
+	reasonBackInConsul         = "back in consul"
+	reasonDeactivationDisabled = "deactivation disabled"
+	reasonExcluded             = "excluded"
+	reasonJobPolicyDelay       = "job policy delay"
+	reasonJobPolicyKeep        = "job policy keep"
+	reasonLiveAlloc            = "live alloc"
+	reasonMatchedQuery         = "matched query"
+	reasonNonNomadClient       = "non-nomad client"
+	reasonNotInConsul          = "not in consul"
+	reasonOrphanedAlloc        = "orphaned alloc"
+	reasonRemovedTask          = "removed task"
+	reasonRequested            = "requested"
+	reasonStale                = "stale"
+	reasonUnknownStatus        = "unknown status"
+	reasonYoungCheckBundle     = "young check bundle"
+)
+
+// Report lists every decision the reaper made during a run, along with the
+// API calls it made and the objects it failed to process.
+type Report struct {
+	lock sync.Mutex
+
+	Run      ReportRun       `json:"run"`
+	Targets  []ReportTarget  `json:"targets"`
+	Metrics  []ReportMetric  `json:"metrics"`
+	RuleSets []ReportRuleSet `json:"rule_sets"`
+
+	Visualizations []ReportVisualization `json:"visualizations"`
+	MetricClusters []ReportMetricCluster `json:"metric_clusters"`
+	BrokerBundles  []ReportBrokerBundle  `json:"broker_bundles"`
+	Budget         *ReportBudget         `json:"budget,omitempty"`
+	Failures       []ReportFailure       `json:"failures"`
+	APICalls       []ReportAPICall       `json:"api_calls"`
+	Stats          map[string]uint       `json:"stats"`
+}
+
+type ReportRun struct {
+	RunID     string    `json:"run_id"`
+	GitCommit string    `json:"git_commit,omitempty"`
+	Mode      string    `json:"mode"`
+	DryRun    bool      `json:"dry_run"`
+	Queries   []string  `json:"queries,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  string    `json:"duration"`
+}
+
+type ReportTarget struct {
+	Target   string `json:"target"`
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+}
+
+type ReportMetric struct {
+	Target         string `json:"target,omitempty"`
+	CheckBundleCID string `json:"check_bundle_cid"`
+	Metric         string `json:"metric"`
+	Status         string `json:"status,omitempty"`
+	Decision       string `json:"decision"`
+	Reason         string `json:"reason"`
+}
+
+type ReportRuleSet struct {
+	CID        string `json:"cid"`
+	CheckCID   string `json:"check_cid"`
+	MetricName string `json:"metric_name"`
+	Action     string `json:"action"`
+}
+
+type ReportVisualization struct {
+	Type           string   `json:"type"`
+	CID            string   `json:"cid"`
+	Title          string   `json:"title"`
+	Owner          string   `json:"owner"`
+	DeadReferences []string `json:"dead_references"`
+}
+
+type ReportMetricCluster struct {
+	CID       string `json:"cid"`
+	Name      string `json:"name"`
+	EmptyRuns uint   `json:"empty_runs"`
+	Action    string `json:"action"`
+}
+
+type ReportBrokerBundle struct {
+	Broker         string `json:"broker"`
+	BrokerStatus   string `json:"broker_status"`
+	CheckBundleCID string `json:"check_bundle_cid"`
+	Target         string `json:"target"`
+	Action         string `json:"action"`
+}
+
+type ReportBudget struct {
+	UsageType string             `json:"usage_type"`
+	Limit     uint               `json:"limit"`
+	Used      uint               `json:"used"`
+	Budget    uint               `json:"budget"`
+	Shed      []ReportShedMetric `json:"shed"`
+}
+
+type ReportShedMetric struct {
+	CheckBundleCID string `json:"check_bundle_cid"`
+	Metric         string `json:"metric"`
+	Rule           string `json:"rule"`
+	Reason         string `json:"reason"`
+}
+
+type ReportFailure struct {
+	Kind  string `json:"kind"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+type ReportAPICall struct {
+	Operation string `json:"operation"`
+	CID       string `json:"cid"`
+	DryRun    bool   `json:"dry_run"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+func newRunReport(runID, gitCommit, mode string, dryRun bool, queries []string) *Report {
+	return &Report{
+		Run: ReportRun{
+			RunID:     runID,
+			GitCommit: gitCommit,
+			Mode:      mode,
+			DryRun:    dryRun,
+			Queries:   queries,
+			Start:     time.Now(),
+		},
+		Targets:  []ReportTarget{},
+		Metrics:  []ReportMetric{},
+		RuleSets: []ReportRuleSet{},
+
+		Visualizations: []ReportVisualization{},
+		MetricClusters: []ReportMetricCluster{},
+		BrokerBundles:  []ReportBrokerBundle{},
+		Failures:       []ReportFailure{},
+		APICalls:       []ReportAPICall{},
+	}
+}
+
+func (r *Report) addTarget(target, decision, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Targets = append(r.Targets, ReportTarget{
+		Target:   target,
+		Decision: decision,
+		Reason:   reason,
+	})
+}
+
+func (r *Report) addMetric(target, checkBundleCID, metric, status, decision, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Metrics = append(r.Metrics, ReportMetric{
+		Target:         target,
+		CheckBundleCID: checkBundleCID,
+		Metric:         metric,
+		Status:         status,
+		Decision:       decision,
+		Reason:         reason,
+	})
+}
+
+func (r *Report) addRuleSet(cid, checkCID, metricName, action string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.RuleSets = append(r.RuleSets, ReportRuleSet{
+		CID:        cid,
+		CheckCID:   checkCID,
+		MetricName: metricName,
+		Action:     action,
+	})
+}
+
+func (r *Report) addVisualization(visualizationType, cid, title, owner string, deadReferences []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Visualizations = append(r.Visualizations, ReportVisualization{
+		Type:           visualizationType,
+		CID:            cid,
+		Title:          title,
+		Owner:          owner,
+		DeadReferences: deadReferences,
+	})
+}
+
+func (r *Report) addMetricCluster(cid, name string, emptyRuns uint, action string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.MetricClusters = append(r.MetricClusters, ReportMetricCluster{
+		CID:       cid,
+		Name:      name,
+		EmptyRuns: emptyRuns,
+		Action:    action,
+	})
+}
+
+func (r *Report) addBrokerBundle(broker, brokerStatus, checkBundleCID, target, action string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.BrokerBundles = append(r.BrokerBundles, ReportBrokerBundle{
+		Broker:         broker,
+		BrokerStatus:   brokerStatus,
+		CheckBundleCID: checkBundleCID,
+		Target:         target,
+		Action:         action,
+	})
+}
+
+// setBudget records the account usage the metric budget was checked against.
+func (r *Report) setBudget(usageType string, limit, used, budget uint) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Budget = &ReportBudget{
+		UsageType: usageType,
+		Limit:     limit,
+		Used:      used,
+		Budget:    budget,
+		Shed:      []ReportShedMetric{},
+	}
+}
+
+func (r *Report) addShedMetric(checkBundleCID, metric, rule, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.Budget == nil {
+		return
+	}
+
+	r.Budget.Shed = append(r.Budget.Shed, ReportShedMetric{
+		CheckBundleCID: checkBundleCID,
+		Metric:         metric,
+		Rule:           rule,
+		Reason:         reason,
+	})
+}
+
+// addFailure records an error against the target, check bundle or other
+// object it belongs to.
+func (r *Report) addFailure(kind, id string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Failures = append(r.Failures, ReportFailure{
+		Kind:  kind,
+		ID:    id,
+		Error: err.Error(),
+	})
+}
+
+func (r *Report) addAPICall(operation, cid string, dryRun bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	call := ReportAPICall{
+		Operation: operation,
+		CID:       cid,
+		DryRun:    dryRun,
+		Success:   err == nil,
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+
+	r.APICalls = append(r.APICalls, call)
+}
+
+// finish stamps the end of the run and snapshots the stats counters.
+func (r *Report) finish(stats *Stats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Run.End = time.Now()
+	r.Run.Duration = r.Run.End.Sub(r.Run.Start).String()
+	r.Stats = map[string]uint{
+		"disabled_targets":              stats.DisabledTargets,
+		"deleted_targets":               stats.DeletedTargets,
+		"excluded_targets":              stats.ExcludedTargets,
+		"reactivated_targets":           stats.ReactivatedTargets,
+		"disabled_metrics":              stats.DisabledMetrics,
+		"enabled_metrics":               stats.EnabledMetrics,
+		"edited_metrics":                stats.EditedMetrics,
+		"nomad_clients":                 stats.NomadClients,
+		"live_allocs":                   stats.LiveAllocs,
+		"active_nomad_alloc_metrics":    stats.ActiveNomadAllocMetrics,
+		"available_nomad_alloc_metrics": stats.AvailableNomadAllocMetrics,
+		"removed_nomad_task_metrics":    stats.RemovedNomadTaskMetrics,
+		"unknown_status_metrics":        stats.UnknownStatusMetrics,
+		"dangling_rule_sets":            stats.DanglingRuleSets,
+		"broken_visualizations":         stats.BrokenVisualizations,
+		"empty_metric_clusters":         stats.EmptyMetricClusters,
+		"orphaned_broker_bundles":       stats.OrphanedBrokerBundles,
+		"stale_metrics":                 stats.StaleMetrics,
+		"shed_metrics":                  stats.ShedMetrics,
+	}
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return errwrap.Wrapf("unable to encode report: {{err}}", err)
+	}
+
+	return nil
+}
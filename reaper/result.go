@@ -0,0 +1,114 @@
+package reaper
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ryanuber/columnize"
+)
+
+// Stats counts what a run found and changed.  In a dry run, the counts are of
+// the changes that would have been made.
+type Stats struct {
+	DisabledTargets    uint
+	DeletedTargets     uint
+	ExcludedTargets    uint
+	ReactivatedTargets uint
+	DisabledMetrics    uint
+	EnabledMetrics     uint
+	EditedMetrics      uint
+
+	// Hosts is the number of hosts in the host inventory and
+	// CirconusTargets the number of targets with active check bundles.
+	Hosts           uint
+	CirconusTargets uint
+
+	NomadClients               uint
+	LiveAllocs                 uint
+	ActiveNomadAllocMetrics    uint
+	AvailableNomadAllocMetrics uint
+	RemovedNomadTaskMetrics    uint
+
+	UnknownStatusMetrics  uint
+	DanglingRuleSets      uint
+	BrokenVisualizations  uint
+	EmptyMetricClusters   uint
+	OrphanedBrokerBundles uint
+	StaleMetrics          uint
+	ShedMetrics           uint
+}
+
+// Result is the outcome of a single run.
+type Result struct {
+	// Report lists every decision made during the run.
+	Report *Report
+
+	Stats Stats
+
+	// Failures are the errors that were handled softly so that the run could
+	// carry on with the remaining targets.
+	Failures []error
+
+	// Incremental is set for the runs Watch does for a batch of changes.
+	// They only reconcile the affected targets, so the inventory counts in
+	// Stats are zero.
+	Incremental bool
+
+	unknownStatusPolicy string
+	ruleSetPolicy       string
+	clusterPolicy       string
+	brokerPolicy        string
+}
+
+// result returns the outcome of the current run.
+func (c *Reaper) result() *Result {
+	r := &Result{
+		Report:              c.report,
+		Stats:               c.stats,
+		unknownStatusPolicy: c.unknownStatusPolicy,
+		ruleSetPolicy:       c.ruleSetPolicy,
+		clusterPolicy:       c.clusterPolicy,
+		brokerPolicy:        c.brokerPolicy,
+	}
+	if c.failures != nil {
+		r.Failures = c.failures.Errors
+	}
+
+	return r
+}
+
+// WriteText writes a human readable summary of the run.
+func (r *Result) WriteText(w io.Writer) {
+	fmt.Fprintln(w, "Summary:")
+	mode := "live"
+	if r.Report.Run.DryRun {
+		mode = "dry-run"
+	}
+	output := []string{
+		fmt.Sprintf("Disabled Targets %s | %d", mode, r.Stats.DisabledTargets),
+		fmt.Sprintf("Deleted Targets %s | %d", mode, r.Stats.DeletedTargets),
+		fmt.Sprintf("Excluded Targets %s | %d", mode, r.Stats.ExcludedTargets),
+		fmt.Sprintf("Re-activated Targets %s | %d", mode, r.Stats.ReactivatedTargets),
+		fmt.Sprintf("Disabled Metrics %s | %d", mode, r.Stats.DisabledMetrics),
+		fmt.Sprintf("Enabled Metrics %s | %d", mode, r.Stats.EnabledMetrics),
+		fmt.Sprintf("Edited Metrics %s | %d", mode, r.Stats.EditedMetrics),
+		fmt.Sprintf("Metrics with Unknown Status %s | %d", r.unknownStatusPolicy, r.Stats.UnknownStatusMetrics),
+		fmt.Sprintf("Number of Nomad Clients | %d", r.Stats.NomadClients),
+		fmt.Sprintf("Number of live allocs | %d", r.Stats.LiveAllocs),
+		fmt.Sprintf("Number of active nomad alloc metrics | %d", r.Stats.ActiveNomadAllocMetrics),
+		fmt.Sprintf("Number of available nomad alloc metrics | %d", r.Stats.AvailableNomadAllocMetrics),
+		fmt.Sprintf("Number of removed nomad task metrics | %d", r.Stats.RemovedNomadTaskMetrics),
+		fmt.Sprintf("Dangling Rule Sets %s | %d", r.ruleSetPolicy, r.Stats.DanglingRuleSets),
+		fmt.Sprintf("Broken Visualizations | %d", r.Stats.BrokenVisualizations),
+		fmt.Sprintf("Empty Metric Clusters %s | %d", r.clusterPolicy, r.Stats.EmptyMetricClusters),
+		fmt.Sprintf("Check Bundles on Inactive Brokers %s | %d", r.brokerPolicy, r.Stats.OrphanedBrokerBundles),
+		fmt.Sprintf("Stale Metrics %s | %d", mode, r.Stats.StaleMetrics),
+		fmt.Sprintf("Metrics Shed for Budget %s | %d", mode, r.Stats.ShedMetrics),
+	}
+	fmt.Fprintln(w, columnize.SimpleFormat(output))
+
+	r.Report.printVisualizations(w)
+	r.Report.printBrokerBundles(w)
+	r.Report.printBudget(w)
+	r.Report.printFailures(w)
+}
@@ -0,0 +1,177 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/hashicorp/errwrap"
+)
+
+// Policies for rule sets that reference metrics the reaper deactivated.
+const (
+	RuleSetPolicyNone    = "none"
+	RuleSetPolicyReport  = "report"
+	RuleSetPolicyDisable = "disable"
+	RuleSetPolicyDelete  = "delete"
+)
+
+// recordReapedMetric remembers that metric was deactivated on each of the
+// given checks of target so that dangling rule sets can be reconciled and the
+// run annotated at the end of the run.
+func (c *Reaper) recordReapedMetric(target string, checkCIDs []string, metric string) {
+	c.deactivatedTargets[target] = append(c.deactivatedTargets[target], metric)
+
+	for _, checkCID := range checkCIDs {
+		metrics, found := c.reapedMetrics[checkCID]
+		if found && metrics == nil {
+			// Every metric on this check has already been reaped.
+			continue
+		}
+		if !found {
+			metrics = make(map[string]struct{})
+			c.reapedMetrics[checkCID] = metrics
+		}
+		metrics[metric] = struct{}{}
+	}
+}
+
+// recordReapedCheckBundle remembers that every metric on the bundle's checks
+// was deactivated.
+func (c *Reaper) recordReapedCheckBundle(checkBundle *circonusapi.CheckBundle) {
+	for _, checkCID := range checkBundle.Checks {
+		c.reapedMetrics[checkCID] = nil
+	}
+}
+
+// reconcileRuleSets finds rule sets whose check and metric name point at
+// metrics deactivated during this run and reports, disables or deletes them
+// according to the configured policy.  Disabling a rule set removes all of its
+// contact groups.  The full rule set is journaled before it is modified.
+func (c *Reaper) reconcileRuleSets(ctx context.Context) error {
+	if c.ruleSetPolicy == RuleSetPolicyNone || len(c.reapedMetrics) == 0 {
+		return nil
+	}
+
+	checkCIDs := make([]string, 0, len(c.reapedMetrics))
+	for checkCID := range c.reapedMetrics {
+		checkCIDs = append(checkCIDs, checkCID)
+	}
+	sort.Strings(checkCIDs)
+
+	for _, checkCID := range checkCIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		reapedMetrics := c.reapedMetrics[checkCID]
+
+		filter := circonusapi.SearchFilterType{
+			"f_check": []string{checkCID},
+		}
+		var ruleSets *[]circonusapi.RuleSet
+		start := time.Now()
+		err := c.apiCall(ctx, func() (err error) {
+			ruleSets, err = c.circonusClient.SearchRuleSets(nil, &filter)
+			return err
+		})
+		c.observeAPICall("SearchRuleSets", start, err)
+		c.report.addAPICall("SearchRuleSets", checkCID, false, err)
+		if err != nil {
+			c.log.Error("unable to search rule sets", "check_cid", checkCID, "error", err)
+			c.recordFailure(failureKindCheck, checkCID, err)
+
+			// NOTE(sean@): treat errors as soft, a single check shouldn't prevent
+			// reconciling the rule sets of every other check.
+			continue
+		}
+
+		if ruleSets == nil {
+			continue
+		}
+
+		for i := range *ruleSets {
+			ruleSet := &(*ruleSets)[i]
+			if reapedMetrics != nil {
+				if _, found := reapedMetrics[ruleSet.MetricName]; !found {
+					continue
+				}
+			}
+
+			c.stats.DanglingRuleSets++
+			c.report.addRuleSet(ruleSet.CID, checkCID, ruleSet.MetricName, c.ruleSetPolicy)
+
+			if err := c.applyRuleSetPolicy(ctx, ruleSet); err != nil {
+				c.log.Error("unable to reconcile rule set", "rule_set_cid", ruleSet.CID, "check_cid", checkCID, "metric", ruleSet.MetricName, "action", c.ruleSetPolicy, "error", err)
+				c.recordFailure(failureKindRuleSet, ruleSet.CID, err)
+				continue
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Reaper) applyRuleSetPolicy(ctx context.Context, ruleSet *circonusapi.RuleSet) error {
+	log := c.log.With("rule_set_cid", ruleSet.CID, "check_cid", ruleSet.CheckCID, "metric", ruleSet.MetricName, "action", c.ruleSetPolicy)
+
+	if c.ruleSetPolicy == RuleSetPolicyReport {
+		log.Info("found rule set referencing a deactivated metric")
+		return nil
+	}
+
+	if c.dryRun {
+		log.Info("dry-run: about to reconcile rule set referencing a deactivated metric")
+		c.report.addAPICall(ruleSetOperation(c.ruleSetPolicy), ruleSet.CID, true, nil)
+		return nil
+	}
+
+	ctx, err := c.beginUpdate(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := c.journal.Record(c.runID, c.ruleSetPolicy, "rule_set", ruleSet.CID, ruleSet); err != nil {
+		return errwrap.Wrapf("unable to journal rule set: {{err}}", err)
+	}
+
+	log.Info("reconciling rule set referencing a deactivated metric")
+
+	var call func() error
+	switch c.ruleSetPolicy {
+	case RuleSetPolicyDisable:
+		disabled := *ruleSet
+		disabled.ContactGroups = map[uint8][]string{1: {}, 2: {}, 3: {}, 4: {}, 5: {}}
+		call = func() error {
+			_, err := c.circonusClient.UpdateRuleSet(&disabled)
+			return err
+		}
+	case RuleSetPolicyDelete:
+		call = func() error {
+			_, err := c.circonusClient.DeleteRuleSet(ruleSet)
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported rule set policy: %q", c.ruleSetPolicy)
+	}
+	start := time.Now()
+	err = c.updateCall(ctx, call)
+	operation := ruleSetOperation(c.ruleSetPolicy)
+	c.observeAPICall(operation, start, err)
+	c.report.addAPICall(operation, ruleSet.CID, false, err)
+
+	return err
+}
+
+func ruleSetOperation(policy string) string {
+	switch policy {
+	case RuleSetPolicyDisable:
+		return "UpdateRuleSet"
+	case RuleSetPolicyDelete:
+		return "DeleteRuleSet"
+	default:
+		return ""
+	}
+}
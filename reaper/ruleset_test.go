@@ -0,0 +1,188 @@
+package reaper
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func TestReconcileRuleSets(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		dryRun       bool
+		fail         map[string]int
+		wantDangling uint
+		// wantRuleSets are the rule sets left, and whether they still
+		// notify any contact group.
+		wantRuleSets map[string]bool
+		wantJournal  int
+		wantFailures int
+	}{
+		{
+			name:   "none",
+			policy: RuleSetPolicyNone,
+			wantRuleSets: map[string]bool{
+				"/rule_set/1_cpu":    true,
+				"/rule_set/1_memory": true,
+				"/rule_set/2_cpu":    true,
+			},
+		},
+		{
+			name:         "report",
+			policy:       RuleSetPolicyReport,
+			wantDangling: 2,
+			wantRuleSets: map[string]bool{
+				"/rule_set/1_cpu":    true,
+				"/rule_set/1_memory": true,
+				"/rule_set/2_cpu":    true,
+			},
+		},
+		{
+			name:         "disable",
+			policy:       RuleSetPolicyDisable,
+			wantDangling: 2,
+			wantRuleSets: map[string]bool{
+				"/rule_set/1_cpu":    false,
+				"/rule_set/1_memory": true,
+				"/rule_set/2_cpu":    false,
+			},
+			wantJournal: 2,
+		},
+		{
+			name:         "delete",
+			policy:       RuleSetPolicyDelete,
+			wantDangling: 2,
+			wantRuleSets: map[string]bool{
+				"/rule_set/1_memory": true,
+			},
+			wantJournal: 2,
+		},
+		{
+			name:         "dry run",
+			policy:       RuleSetPolicyDelete,
+			dryRun:       true,
+			wantDangling: 2,
+			wantRuleSets: map[string]bool{
+				"/rule_set/1_cpu":    true,
+				"/rule_set/1_memory": true,
+				"/rule_set/2_cpu":    true,
+			},
+		},
+		{
+			name:         "failed delete",
+			policy:       RuleSetPolicyDelete,
+			fail:         map[string]int{"DELETE /rule_set/1_cpu": 403},
+			wantDangling: 2,
+			wantRuleSets: map[string]bool{
+				"/rule_set/1_cpu":    true,
+				"/rule_set/1_memory": true,
+			},
+			wantJournal:  2,
+			wantFailures: 1,
+		},
+		{
+			name:         "failed search",
+			policy:       RuleSetPolicyDelete,
+			fail:         map[string]int{"GET /rule_set": 403},
+			wantDangling: 0,
+			wantRuleSets: map[string]bool{
+				"/rule_set/1_cpu":    true,
+				"/rule_set/1_memory": true,
+				"/rule_set/2_cpu":    true,
+			},
+			wantFailures: 2,
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "reaper-rule-sets")
+		if err != nil {
+			t.Fatalf("unable to create journal dir: %v", err)
+		}
+		journalFile := filepath.Join(dir, "journal.jsonl")
+
+		f := newFakeCirconus(t)
+		for _, ruleSet := range []struct{ cid, check, metric string }{
+			{"/rule_set/1_cpu", "/check/1", "cpu"},
+			{"/rule_set/1_memory", "/check/1", "memory"},
+			{"/rule_set/2_cpu", "/check/2", "cpu"},
+		} {
+			f.ruleSets[ruleSet.cid] = &circonusapi.RuleSet{
+				CID:           ruleSet.cid,
+				CheckCID:      ruleSet.check,
+				MetricName:    ruleSet.metric,
+				MetricType:    "numeric",
+				ContactGroups: map[uint8][]string{1: {"/contact_group/1"}},
+				Rules:         []circonusapi.RuleSetRule{},
+			}
+		}
+		for req, code := range test.fail {
+			f.fail[req] = code
+		}
+
+		c := newTestReaper(t, f, Config{
+			Mode:          ModeStale,
+			RuleSetPolicy: test.policy,
+			JournalFile:   journalFile,
+			DryRun:        test.dryRun,
+		})
+
+		// Only cpu was deactivated on check 1, but the whole of check 2 was.
+		c.recordReapedMetric("web1", []string{"/check/1"}, "cpu")
+		c.recordReapedCheckBundle(&circonusapi.CheckBundle{Checks: []string{"/check/2"}})
+
+		if err := c.reconcileRuleSets(context.Background()); err != nil {
+			t.Errorf("%s: reconcileRuleSets() = %v", test.name, err)
+		}
+
+		ruleSets := make(map[string]bool, len(f.ruleSets))
+		for cid, ruleSet := range f.ruleSets {
+			alerting := false
+			for _, contactGroups := range ruleSet.ContactGroups {
+				if len(contactGroups) > 0 {
+					alerting = true
+				}
+			}
+			ruleSets[cid] = alerting
+		}
+		if !reflect.DeepEqual(ruleSets, test.wantRuleSets) {
+			t.Errorf("%s: got rule sets %v, want %v", test.name, ruleSets, test.wantRuleSets)
+		}
+		if c.stats.DanglingRuleSets != test.wantDangling {
+			t.Errorf("%s: %d dangling rule sets, want %d", test.name, c.stats.DanglingRuleSets, test.wantDangling)
+		}
+		if got := countLines(t, journalFile); got != test.wantJournal {
+			t.Errorf("%s: %d journal entries, want %d", test.name, got, test.wantJournal)
+		}
+		if got := c.numFailures(); got != test.wantFailures {
+			t.Errorf("%s: %d failures, want %d", test.name, got, test.wantFailures)
+		}
+
+		f.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// countLines returns the number of lines in the file at path.
+func countLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open %q: %v", path, err)
+	}
+	defer file.Close()
+
+	var n int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+	}
+
+	return n
+}
@@ -0,0 +1,142 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// Run performs a single run in the configured mode.  The result is returned
+// even if the run failed part way through: it covers what was reaped before
+// the failure.
+func (c *Reaper) Run(ctx context.Context) (*Result, error) {
+	if c.mode == "" {
+		return nil, fmt.Errorf("no mode to run in")
+	}
+
+	return c.runCycle(ctx, c.mode, c.reap)
+}
+
+// runCycle wraps a single pass of reap with annotations and the reaper's own
+// metrics.  reap is bounded by the run timeout, if any, and its run is
+// reported as mode.
+func (c *Reaper) runCycle(ctx context.Context, mode string, reap func(context.Context) error) (*Result, error) {
+	c.reset(mode)
+	runStart := time.Now()
+
+	runCtx := ctx
+	if c.runTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, c.runTimeout)
+		defer cancel()
+	}
+
+	// Updates outlive the run's cancellation but not its deadline.
+	c.updateCtx = context.Background()
+	if deadline, ok := runCtx.Deadline(); ok {
+		var cancel context.CancelFunc
+		c.updateCtx, cancel = context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+	}
+
+	runErr := reap(runCtx)
+	switch {
+	case runErr != nil && runCtx.Err() != nil:
+		c.log.Error("run stopped before completing", "error", runErr, "cause", runCtx.Err())
+	case runErr != nil:
+		c.log.Error("run failed", "error", runErr)
+	case c.numFailures() > 0:
+		c.log.Warn("run finished with failures", "failures", c.numFailures(), "error", c.failures)
+	}
+
+	if err := c.saveCache(); err != nil {
+		c.log.Error("unable to save check bundle cache", "error", err)
+	}
+
+	// The run's context may be done by now, but what was reaped is still
+	// annotated.
+	if err := c.annotateRun(context.Background()); err != nil {
+		c.log.Error("unable to annotate run", "error", err)
+	}
+
+	c.report.finish(&c.stats)
+
+	if err := c.submitMetrics(runStart, runErr); err != nil {
+		c.log.Error("unable to submit reaper metrics", "error", err)
+	}
+
+	return c.result(), runErr
+}
+
+func (c *Reaper) reap(ctx context.Context) error {
+	switch c.mode {
+	case ModeAudit:
+		if err := c.auditVisualizations(ctx); err != nil {
+			return errwrap.Wrapf("unable to audit visualizations: {{err}}", err)
+		}
+	case ModeBrokers:
+		if err := c.reapOrphanedBrokerBundles(ctx); err != nil {
+			return errwrap.Wrapf("unable to reap check bundles on inactive brokers: {{err}}", err)
+		}
+	case ModeBudget:
+		if err := c.enforceMetricBudget(ctx); err != nil {
+			return errwrap.Wrapf("unable to enforce metric budget: {{err}}", err)
+		}
+	case ModeClusters:
+		if err := c.reapMetricClusters(ctx); err != nil {
+			return errwrap.Wrapf("unable to reap metric clusters: {{err}}", err)
+		}
+	case ModeQuery:
+		if err := c.applyMatchingQueries(ctx); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to %s metrics matching queries: {{err}}", c.queryAction), err)
+		}
+	case ModeStale:
+		if err := c.deactivateStaleMetrics(ctx); err != nil {
+			return errwrap.Wrapf("unable to deactivate stale metrics: {{err}}", err)
+		}
+	case ModeHosts, ModeAllocs, ModeConsulNomad:
+		if c.mode != ModeAllocs {
+			if c.reactivateHosts {
+				if err := c.reactivateReturningHosts(ctx); err != nil {
+					return errwrap.Wrapf("unable to re-activate returning hosts: {{err}}", err)
+				}
+			}
+
+			if err := c.deactivateUnknownHosts(ctx); err != nil {
+				return errwrap.Wrapf("unable to deactivate unknown hosts: {{err}}", err)
+			}
+		}
+
+		if c.mode != ModeHosts {
+			if err := c.deactivateNomadCompletedAllocs(ctx); err != nil {
+				return errwrap.Wrapf("unable to deactivate completed nomad allocs: {{err}}", err)
+			}
+		}
+	}
+
+	if err := c.reconcileRuleSets(ctx); err != nil {
+		return errwrap.Wrapf("unable to reconcile rule sets: {{err}}", err)
+	}
+
+	return nil
+}
+
+// reset clears the caches, stats counters and failures accumulated during the
+// previous run so that the next run, in mode, starts from a fresh inventory.
+func (c *Reaper) reset(mode string) {
+	c.circonusTargetsCache = nil
+	c.consulHostCache = nil
+	c.cacheSynced = false
+	c.failures = nil
+	c.jobPolicyCache = make(map[string]*NomadJobPolicy)
+	c.allocCache = make(map[string]*nomadapi.Allocation)
+	c.reapedMetrics = make(map[string]map[string]struct{})
+	c.deactivatedTargets = make(map[string][]string)
+	c.runID = newRunID()
+	c.log = c.logger.With("run_id", c.runID, "mode", mode)
+	c.report = newRunReport(c.runID, c.gitCommit, mode, c.dryRun, c.metricQueries)
+	c.stats = Stats{}
+}
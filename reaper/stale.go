@@ -0,0 +1,314 @@
+package reaper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/hashicorp/errwrap"
+)
+
+// metricSearchPageSize is the number of metrics requested per page of a metric
+// search.
+const metricSearchPageSize = 1000
+
+// metricData is the subset of a /data response needed to find the most recent
+// data point.  Each point is a [timestamp, value] pair; value is null for
+// periods without data.
+type metricData struct {
+	Data [][]json.RawMessage `json:"data"`
+}
+
+// deactivateStaleMetrics finds active metrics (optionally limited to those
+// matching -query) that have not received any data within the staleness
+// threshold and flips them to available.
+func (c *Reaper) deactivateStaleMetrics(ctx context.Context) error {
+	queries := []string{"(active:1)"}
+	if len(c.metricQueries) > 0 {
+		queries = make([]string, 0, len(c.metricQueries))
+		for _, query := range c.metricQueries {
+			queries = append(queries, fmt.Sprintf("%s (active:1)", query))
+		}
+	}
+
+	var metrics []circonusapi.Metric
+	for _, query := range queries {
+		matched, err := c.searchAllMetrics(ctx, query)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to search Circonus for metrics matching %q: {{err}}", query), err)
+		}
+
+		metrics = append(metrics, matched...)
+	}
+
+	now := time.Now()
+	since := now.Add(-c.staleAfter)
+
+	// Group stale metric names by check bundle so each bundle is updated once.
+	staleByCheckBundle := make(map[string]map[string]struct{})
+	var fetched uint
+	metrics = shuffledMetrics(metrics)
+	for i, metric := range metrics {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !metric.CheckActive || metric.CheckBundleCID == "" {
+			continue
+		}
+
+		if _, found := staleByCheckBundle[metric.CheckBundleCID][metric.MetricName]; found {
+			continue
+		}
+
+		if fetched >= c.staleMaxMetrics {
+			c.log.Warn("stale metric limit reached, the remaining metrics are checked in a later run", "limit", c.staleMaxMetrics, "remaining", len(metrics)-i)
+			break
+		}
+		fetched++
+
+		lastData, err := c.fetchLastDataPoint(ctx, &metric, since, now)
+		if err != nil {
+			c.log.Error("unable to fetch metric data", "check_bundle_cid", metric.CheckBundleCID, "metric", metric.MetricName, "error", err)
+			c.recordFailure(failureKindMetric, metric.CID, err)
+
+			// NOTE(sean@): treat errors as soft, a metric whose data can't be
+			// fetched is never assumed to be stale.
+			continue
+		}
+
+		if !lastData.IsZero() {
+			c.log.Trace("metric has recent data", "check_bundle_cid", metric.CheckBundleCID, "metric", metric.MetricName, "last_data", lastData.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		if _, found := staleByCheckBundle[metric.CheckBundleCID]; !found {
+			staleByCheckBundle[metric.CheckBundleCID] = make(map[string]struct{})
+		}
+		staleByCheckBundle[metric.CheckBundleCID][metric.MetricName] = struct{}{}
+	}
+
+	checkBundleCIDs := make([]string, 0, len(staleByCheckBundle))
+	for checkBundleCID := range staleByCheckBundle {
+		checkBundleCIDs = append(checkBundleCIDs, checkBundleCID)
+	}
+	sort.Strings(checkBundleCIDs)
+
+	for _, checkBundleCID := range checkBundleCIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := c.deactivateStaleBundleMetrics(ctx, checkBundleCID, staleByCheckBundle[checkBundleCID]); err != nil {
+			c.log.Error("unable to deactivate stale metrics", "check_bundle_cid", checkBundleCID, "error", err)
+			c.recordFailure(failureKindCheckBundle, checkBundleCID, err)
+
+			// NOTE(sean@): treat errors as soft because we want to try updating
+			// check_bundle_metrics for all bundles vs getting hung up on a
+			// single bundle that may be failing for some reason.
+			continue
+		}
+	}
+
+	return nil
+}
+
+// deactivateStaleBundleMetrics flips the named metrics on a single check bundle
+// from active to available.  Circonus doesn't expose when a metric was
+// created, so the metrics of a check bundle created within the staleness
+// threshold are taken to be too young to have data and are left alone.
+func (c *Reaper) deactivateStaleBundleMetrics(ctx context.Context, checkBundleCID string, stale map[string]struct{}) error {
+	checkBundle, err := c.fetchCheckBundle(ctx, checkBundleCID)
+	if err != nil {
+		return err
+	}
+
+	target := checkBundle.Target
+	if c.excludeTarget(target) {
+		c.log.Info("skipping stale metrics on excluded target", "target", target, "check_bundle_cid", checkBundleCID, "action", decisionSkip)
+		for metricName := range stale {
+			c.report.addMetric(target, checkBundleCID, metricName, "active", decisionSkip, reasonExcluded)
+		}
+		return nil
+	}
+
+	if created := time.Unix(int64(checkBundle.Created), 0); time.Since(created) < c.staleAfter {
+		c.log.Debug("skipping stale metrics on young check bundle", "target", target, "check_bundle_cid", checkBundleCID, "created", created.UTC().Format(time.RFC3339), "action", decisionSkip)
+		for metricName := range stale {
+			c.report.addMetric(target, checkBundleCID, metricName, "active", decisionSkip, reasonYoungCheckBundle)
+		}
+		return nil
+	}
+
+	cbm, err := c.fetchCheckBundleMetrics(ctx, checkBundleCID)
+	if err != nil {
+		return err
+	}
+
+	var deactivated []string
+	for i, metric := range cbm.Metrics {
+		if _, found := stale[metric.Name]; !found {
+			continue
+		}
+		if status, ok := c.metricStatusOf(target, checkBundleCID, &cbm.Metrics[i]); !ok || status != metricStatusActive {
+			continue
+		}
+
+		c.log.Debug("deactivating stale metric", "target", target, "check_bundle_cid", checkBundleCID, "metric", metric.Name, "stale_after", c.staleAfter.String())
+		cbm.Metrics[i].Status = string(metricStatusAvailable)
+		deactivated = append(deactivated, metric.Name)
+		c.stats.StaleMetrics++
+		c.stats.DisabledMetrics++
+		c.report.addMetric(target, checkBundleCID, metric.Name, metric.Status, decisionDeactivate, reasonStale)
+	}
+
+	if len(deactivated) == 0 {
+		return nil
+	}
+
+	if err := c.updateCheckBundleMetrics(ctx, target, checkBundleCID, checkBundle.Checks, cbm); err != nil {
+		return err
+	}
+
+	for _, metricName := range deactivated {
+		c.recordReapedMetric(target, checkBundle.Checks, metricName)
+	}
+
+	return nil
+}
+
+// searchAllMetrics returns every metric matching query, fetching the results
+// a page of metricSearchPageSize at a time until a short page.
+func (c *Reaper) searchAllMetrics(ctx context.Context, query string) ([]circonusapi.Metric, error) {
+	searchQuery := circonusapi.SearchQueryType(query)
+
+	var metrics []circonusapi.Metric
+	for offset := 0; ; offset += metricSearchPageSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		filter := circonusapi.SearchFilterType{
+			"size":   []string{strconv.Itoa(metricSearchPageSize)},
+			"offset": []string{strconv.Itoa(offset)},
+		}
+
+		var page *[]circonusapi.Metric
+		start := time.Now()
+		err := c.apiCall(ctx, func() (err error) {
+			page, err = c.circonusClient.SearchMetrics(&searchQuery, &filter)
+			return err
+		})
+		c.observeAPICall("SearchMetrics", start, err)
+		c.report.addAPICall("SearchMetrics", config.MetricPrefix, false, err)
+		if err != nil {
+			return nil, err
+		}
+
+		if page == nil {
+			break
+		}
+		metrics = append(metrics, *page...)
+		if len(*page) < metricSearchPageSize {
+			break
+		}
+	}
+
+	return metrics, nil
+}
+
+// shuffledMetrics returns the metrics in random order so that runs cut short
+// by the stale metric limit eventually check every metric.
+func shuffledMetrics(metrics []circonusapi.Metric) []circonusapi.Metric {
+	shuffled := make([]circonusapi.Metric, len(metrics))
+	for i, j := range rand.Perm(len(metrics)) {
+		shuffled[i] = metrics[j]
+	}
+
+	return shuffled
+}
+
+// fetchLastDataPoint returns the time of the most recent non-null data point
+// for the metric between since and until, or the zero time if there is none.
+func (c *Reaper) fetchLastDataPoint(ctx context.Context, metric *circonusapi.Metric, since, until time.Time) (time.Time, error) {
+	checkID := strings.TrimPrefix(metric.CheckCID, config.CheckPrefix+"/")
+	if checkID == "" || checkID == metric.CheckCID {
+		return time.Time{}, fmt.Errorf("unable to extract check ID from %q", metric.CheckCID)
+	}
+
+	dataType := "numeric"
+	switch {
+	case metric.MetricType == "histogram" || metric.Histogram == "true":
+		dataType = "histogram"
+	case metric.MetricType == "text":
+		dataType = "text"
+	}
+
+	params := url.Values{}
+	params.Set("start", fmt.Sprintf("%d", since.Unix()))
+	params.Set("end", fmt.Sprintf("%d", until.Unix()))
+	params.Set("period", fmt.Sprintf("%d", stalePeriod(until.Sub(since))))
+	params.Set("type", dataType)
+
+	dataPath := fmt.Sprintf("/data/%s_%s?%s", checkID, url.PathEscape(metric.MetricName), params.Encode())
+	var buf []byte
+	start := time.Now()
+	err := c.apiCall(ctx, func() (err error) {
+		buf, err = c.circonusClient.Get(dataPath)
+		return err
+	})
+	c.observeAPICall("FetchData", start, err)
+	c.report.addAPICall("FetchData", metric.CID, false, err)
+	if err != nil {
+		return time.Time{}, errwrap.Wrapf(fmt.Sprintf("unable to fetch data for %q: {{err}}", metric.CID), err)
+	}
+
+	var data metricData
+	if err := json.Unmarshal(buf, &data); err != nil {
+		return time.Time{}, errwrap.Wrapf(fmt.Sprintf("unable to decode data for %q: {{err}}", metric.CID), err)
+	}
+
+	var last int64
+	for _, point := range data.Data {
+		if len(point) < 2 || string(point[1]) == "null" {
+			continue
+		}
+
+		var ts int64
+		if err := json.Unmarshal(point[0], &ts); err != nil {
+			continue
+		}
+		if ts > last {
+			last = ts
+		}
+	}
+
+	if last == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(last, 0), nil
+}
+
+// stalePeriod picks the coarsest rollup period Circonus supports that still
+// yields a reasonable number of points for the given window.
+func stalePeriod(window time.Duration) int {
+	switch {
+	case window <= 24*time.Hour:
+		return 300
+	case window <= 7*24*time.Hour:
+		return 1800
+	case window <= 30*24*time.Hour:
+		return 10800
+	default:
+		return 86400
+	}
+}
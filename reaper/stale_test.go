@@ -0,0 +1,66 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func TestDeactivateStaleMetricsPaging(t *testing.T) {
+	tests := []struct {
+		name         string
+		others       int
+		wantSearches int
+	}{
+		{name: "single page", others: 10, wantSearches: 1},
+		{name: "exactly one full page", others: metricSearchPageSize - 1, wantSearches: 2},
+		{name: "stale metric on the second page", others: metricSearchPageSize, wantSearches: 2},
+		{name: "stale metric on the third page", others: 2*metricSearchPageSize + 5, wantSearches: 3},
+	}
+
+	for _, test := range tests {
+		f := newFakeCirconus(t)
+		f.addCheckBundle(1, "web1", "cpu", "memory")
+
+		// Metrics of inactive checks are never checked for data, so only the
+		// last metric found is stale.
+		for i := 0; i < test.others; i++ {
+			f.metrics = append(f.metrics, circonusapi.Metric{
+				Active:         true,
+				CheckBundleCID: "/check_bundle/2",
+				CheckCID:       "/check/2",
+				CID:            fmt.Sprintf("/metric/2_m%d", i),
+				MetricName:     fmt.Sprintf("m%d", i),
+			})
+		}
+		f.metrics = append(f.metrics, circonusapi.Metric{
+			Active:         true,
+			CheckActive:    true,
+			CheckBundleCID: "/check_bundle/1",
+			CheckCID:       "/check/1",
+			CID:            "/metric/1_cpu",
+			MetricName:     "cpu",
+		})
+
+		c := newTestReaper(t, f, Config{Mode: ModeStale})
+		if err := c.deactivateStaleMetrics(context.Background()); err != nil {
+			t.Errorf("%s: deactivateStaleMetrics() = %v", test.name, err)
+		}
+
+		if got := f.countRequests("GET /metric?"); got != test.wantSearches {
+			t.Errorf("%s: searched %d pages, want %d", test.name, got, test.wantSearches)
+		}
+
+		statuses := f.metricStatuses("/check_bundle/1")
+		if statuses["cpu"] != "available" || statuses["memory"] != "active" {
+			t.Errorf("%s: metric statuses %v, want cpu available and memory active", test.name, statuses)
+		}
+		if c.stats.StaleMetrics != 1 {
+			t.Errorf("%s: %d stale metrics, want 1", test.name, c.stats.StaleMetrics)
+		}
+
+		f.Close()
+	}
+}
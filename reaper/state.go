@@ -0,0 +1,121 @@
+package reaper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/errwrap"
+)
+
+// StateStore persists reaper state between runs.
+type StateStore interface {
+	// Load decodes the stored state into v.  v is left untouched if no state
+	// has been stored yet.
+	Load(v interface{}) error
+
+	// Save replaces the stored state with v.
+	Save(v interface{}) error
+}
+
+// fileStateStore keeps state in a JSON file on local disk.
+type fileStateStore struct {
+	path string
+}
+
+// NewFileStateStore returns a StateStore that keeps state in the JSON file at
+// path.
+func NewFileStateStore(path string) StateStore {
+	return &fileStateStore{path: path}
+}
+
+func (s *fileStateStore) Load(v interface{}) error {
+	buf, err := ioutil.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return errwrap.Wrapf(fmt.Sprintf("unable to read state file %q: {{err}}", s.path), err)
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to decode state file %q: {{err}}", s.path), err)
+	}
+
+	return nil
+}
+
+func (s *fileStateStore) Save(v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errwrap.Wrapf("unable to encode state: {{err}}", err)
+	}
+
+	// Write to a temporary file and rename it into place so that a crash never
+	// leaves a truncated state file behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to create temporary state file for %q: {{err}}", s.path), err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return errwrap.Wrapf(fmt.Sprintf("unable to write state file %q: {{err}}", tmp.Name()), err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to close state file %q: {{err}}", tmp.Name()), err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to rename state file to %q: {{err}}", s.path), err)
+	}
+
+	return nil
+}
+
+// consulStateStore keeps state as a JSON document in the Consul KV store.
+type consulStateStore struct {
+	kv  *consulapi.KV
+	key string
+}
+
+// NewConsulStateStore returns a StateStore that keeps state under key in the
+// Consul KV store.
+func NewConsulStateStore(kv *consulapi.KV, key string) StateStore {
+	return &consulStateStore{kv: kv, key: key}
+}
+
+func (s *consulStateStore) Load(v interface{}) error {
+	pair, _, err := s.kv.Get(s.key, nil)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to read Consul key %q: {{err}}", s.key), err)
+	}
+
+	if pair == nil || len(pair.Value) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(pair.Value, v); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to decode Consul key %q: {{err}}", s.key), err)
+	}
+
+	return nil
+}
+
+func (s *consulStateStore) Save(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return errwrap.Wrapf("unable to encode state: {{err}}", err)
+	}
+
+	if _, err := s.kv.Put(&consulapi.KVPair{Key: s.key, Value: buf}, nil); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to write Consul key %q: {{err}}", s.key), err)
+	}
+
+	return nil
+}
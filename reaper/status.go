@@ -0,0 +1,59 @@
+package reaper
+
+import (
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+)
+
+// metricStatus is the status of a metric in a check bundle's
+// check_bundle_metrics.
+type metricStatus string
+
+// The metric statuses Circonus knows about.  Active metrics are collected and
+// count against the account's metric limit; available metrics are known to
+// the check but not collected.
+const (
+	metricStatusActive    metricStatus = "active"
+	metricStatusAvailable metricStatus = "available"
+)
+
+func (s metricStatus) known() bool {
+	switch s {
+	case metricStatusActive, metricStatusAvailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// Policies for metrics with a status the reaper doesn't know.
+const (
+	UnknownStatusPolicySkip   = "skip"
+	UnknownStatusPolicyReport = "report"
+	UnknownStatusPolicyActive = "active"
+)
+
+// metricStatusOf returns the status of a check bundle metric.  A metric with
+// an unknown status is counted and handled according to the unknown status
+// policy: false is returned if the metric should be left alone.
+func (c *Reaper) metricStatusOf(target, checkBundleCID string, metric *circonusapi.CheckBundleMetric) (metricStatus, bool) {
+	status := metricStatus(metric.Status)
+	if status.known() {
+		return status, true
+	}
+
+	c.stats.UnknownStatusMetrics++
+	log := c.log.With("target", target, "check_bundle_cid", checkBundleCID, "metric", metric.Name, "status", metric.Status, "policy", c.unknownStatusPolicy)
+
+	switch c.unknownStatusPolicy {
+	case UnknownStatusPolicyActive:
+		log.Warn("treating metric with unknown status as active")
+		return metricStatusActive, true
+	case UnknownStatusPolicyReport:
+		log.Warn("skipping metric with unknown status", "action", decisionSkip)
+		c.report.addMetric(target, checkBundleCID, metric.Name, metric.Status, decisionSkip, reasonUnknownStatus)
+	default:
+		log.Debug("skipping metric with unknown status", "action", decisionSkip)
+	}
+
+	return status, false
+}
@@ -0,0 +1,48 @@
+package reaper
+
+import (
+	"io/ioutil"
+	"testing"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func TestMetricStatusOf(t *testing.T) {
+	tests := []struct {
+		status       string
+		policy       string
+		wantStatus   metricStatus
+		wantOK       bool
+		wantUnknown  uint
+		wantReported int
+	}{
+		{status: "active", policy: UnknownStatusPolicyReport, wantStatus: metricStatusActive, wantOK: true},
+		{status: "available", policy: UnknownStatusPolicyReport, wantStatus: metricStatusAvailable, wantOK: true},
+		{status: "active", policy: UnknownStatusPolicySkip, wantStatus: metricStatusActive, wantOK: true},
+		{status: "archived", policy: UnknownStatusPolicySkip, wantStatus: "archived", wantUnknown: 1},
+		{status: "archived", policy: UnknownStatusPolicyReport, wantStatus: "archived", wantUnknown: 1, wantReported: 1},
+		{status: "archived", policy: UnknownStatusPolicyActive, wantStatus: metricStatusActive, wantOK: true, wantUnknown: 1},
+		{status: "", policy: UnknownStatusPolicyReport, wantStatus: "", wantUnknown: 1, wantReported: 1},
+		{status: "Active", policy: UnknownStatusPolicySkip, wantStatus: "Active", wantUnknown: 1},
+	}
+
+	for _, test := range tests {
+		c := &Reaper{
+			logger:              NewLogger(ioutil.Discard, LevelError, LogFormatText),
+			unknownStatusPolicy: test.policy,
+		}
+		c.reset(ModeAllocs)
+
+		metric := &circonusapi.CheckBundleMetric{Name: "cpu`idle", Status: test.status}
+		status, ok := c.metricStatusOf("host", "/check_bundle/1", metric)
+		if status != test.wantStatus || ok != test.wantOK {
+			t.Errorf("metricStatusOf(%q) with policy %q = %q, %v, want %q, %v", test.status, test.policy, status, ok, test.wantStatus, test.wantOK)
+		}
+		if c.stats.UnknownStatusMetrics != test.wantUnknown {
+			t.Errorf("metricStatusOf(%q) with policy %q counted %d unknown status metrics, want %d", test.status, test.policy, c.stats.UnknownStatusMetrics, test.wantUnknown)
+		}
+		if len(c.report.Metrics) != test.wantReported {
+			t.Errorf("metricStatusOf(%q) with policy %q reported %d metrics, want %d", test.status, test.policy, len(c.report.Metrics), test.wantReported)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package reaper
+
+import (
+	"context"
+	"time"
+
+	circonusapi "github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/hashicorp/errwrap"
+)
+
+// modeTargets is the mode recorded for runs of ReapTargets.
+const modeTargets = "reap-target"
+
+// Actions ReapTargets takes on the check bundles of its targets.
+const (
+	TargetActionDeactivate = "deactivate"
+	TargetActionDelete     = "delete"
+)
+
+// ReapTargets deactivates, or deletes if the target action is
+// TargetActionDelete, the check bundles of the given targets right away.  The
+// host inventory isn't consulted: the targets are taken to be gone.  Excluded
+// targets are skipped and every change is journaled, as in any other run.
+func (c *Reaper) ReapTargets(ctx context.Context, targets []string) (*Result, error) {
+	return c.runCycle(ctx, modeTargets, func(ctx context.Context) error {
+		if err := c.reapTargets(ctx, targets, c.targetAction, reasonRequested); err != nil {
+			return err
+		}
+
+		if err := c.reconcileRuleSets(ctx); err != nil {
+			return errwrap.Wrapf("unable to reconcile rule sets: {{err}}", err)
+		}
+
+		return nil
+	})
+}
+
+// deleteCheckBundle journals and deletes the check bundle.  ctx is expected to
+// come from beginUpdate.
+func (c *Reaper) deleteCheckBundle(ctx context.Context, checkBundle *circonusapi.CheckBundle) error {
+	if c.journal != nil {
+		if err := c.journal.Record(c.runID, decisionDelete, "check_bundle", checkBundle.CID, checkBundle); err != nil {
+			return errwrap.Wrapf("unable to journal check bundle: {{err}}", err)
+		}
+	}
+
+	start := time.Now()
+	err := c.updateCall(ctx, func() error {
+		_, err := c.circonusClient.DeleteCheckBundle(checkBundle)
+		return err
+	})
+	c.observeAPICall("DeleteCheckBundle", start, err)
+	c.report.addAPICall("DeleteCheckBundle", checkBundle.CID, false, err)
+	if err != nil {
+		return err
+	}
+
+	c.evictCachedCheckBundle(checkBundle.CID)
+
+	return nil
+}
@@ -0,0 +1,439 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/errwrap"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	// watchWaitTime is how long a blocking query waits for a change before
+	// returning the unchanged result.
+	watchWaitTime = 5 * time.Minute
+
+	// watchRetryInterval is how long a watcher backs off after a failed query.
+	watchRetryInterval = 10 * time.Second
+
+	// watchSettleTime is how long changes are batched before the affected
+	// targets are reconciled.
+	watchSettleTime = 10 * time.Second
+)
+
+// watchDelta is a batch of inventory changes seen by the watchers.
+type watchDelta struct {
+	// deregisteredNodes are Consul nodes that left the catalog.
+	deregisteredNodes map[string]struct{}
+
+	// registeredNodes are Consul nodes that joined the catalog.
+	registeredNodes map[string]struct{}
+
+	// allocNodeIDs are Nomad node IDs with an alloc that started or stopped.
+	allocNodeIDs map[string]struct{}
+}
+
+func newWatchDelta() *watchDelta {
+	return &watchDelta{
+		deregisteredNodes: make(map[string]struct{}),
+		registeredNodes:   make(map[string]struct{}),
+		allocNodeIDs:      make(map[string]struct{}),
+	}
+}
+
+func (d *watchDelta) empty() bool {
+	return len(d.deregisteredNodes) == 0 && len(d.registeredNodes) == 0 && len(d.allocNodeIDs) == 0
+}
+
+// merge folds other into d.  A node that left and came back within the same
+// batch cancels out.
+func (d *watchDelta) merge(other *watchDelta) {
+	for node := range other.deregisteredNodes {
+		if _, found := d.registeredNodes[node]; found {
+			delete(d.registeredNodes, node)
+			continue
+		}
+		d.deregisteredNodes[node] = struct{}{}
+	}
+	for node := range other.registeredNodes {
+		if _, found := d.deregisteredNodes[node]; found {
+			delete(d.deregisteredNodes, node)
+			continue
+		}
+		d.registeredNodes[node] = struct{}{}
+	}
+	for nodeID := range other.allocNodeIDs {
+		d.allocNodeIDs[nodeID] = struct{}{}
+	}
+}
+
+// Watch does a full run and then watches the Consul catalog and the Nomad
+// allocs with blocking queries, reconciling only the targets affected by each
+// batch of changes, until ctx is cancelled.  The watchers take their baseline
+// before the full run, so changes made while it lists the inventories are
+// reconciled afterwards rather than lost.  done is called with the outcome of
+// every run.  Only ModeHosts, ModeAllocs and ModeConsulNomad can be
+// watched: the Consul catalog requires the Consul host inventory and the
+// Nomad allocs require the Nomad alloc inventory.
+func (c *Reaper) Watch(ctx context.Context, done func(*Result, error)) error {
+	switch c.mode {
+	case ModeHosts, ModeAllocs, ModeConsulNomad:
+	default:
+		return fmt.Errorf("%s mode can not be watched", c.mode)
+	}
+
+	var consul *ConsulInventory
+	if c.mode != ModeAllocs {
+		var ok bool
+		if consul, ok = c.hosts.(*ConsulInventory); !ok {
+			return fmt.Errorf("watching requires the Consul host inventory")
+		}
+	}
+
+	var nomad *NomadInventory
+	if c.mode != ModeHosts {
+		var ok bool
+		if nomad, ok = c.allocs.(*NomadInventory); !ok {
+			return fmt.Errorf("watching requires the Nomad alloc inventory")
+		}
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	deltaCh := make(chan *watchDelta)
+	var ready []chan struct{}
+	if consul != nil {
+		consulReady := make(chan struct{})
+		go c.watchConsulNodes(watchCtx, consul.client, consulReady, deltaCh)
+		ready = append(ready, consulReady)
+	}
+	if nomad != nil {
+		nomadReady := make(chan struct{})
+		go c.watchNomadAllocs(watchCtx, nomad.client, nomadReady, deltaCh)
+		ready = append(ready, nomadReady)
+	}
+
+	for _, ch := range ready {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	done(c.Run(ctx))
+
+	pending := newWatchDelta()
+	var settleCh <-chan time.Time
+	delayCh := c.nextDelayedAlloc()
+	for {
+		select {
+		case <-delayCh:
+			// Allocs kept by a delay policy have become reapable, but their
+			// nodes may not change again: reconcile them now.
+			pending.allocNodeIDs = c.dueDelayedAllocNodes(pending.allocNodeIDs, time.Now())
+			delayCh = c.nextDelayedAlloc()
+			if settleCh == nil {
+				settleCh = time.After(watchSettleTime)
+			}
+		case delta := <-deltaCh:
+			pending.merge(delta)
+			if settleCh == nil {
+				settleCh = time.After(watchSettleTime)
+			}
+		case <-settleCh:
+			settleCh = nil
+			if pending.empty() {
+				continue
+			}
+
+			delta := pending
+			pending = newWatchDelta()
+
+			result, err := c.runCycle(ctx, c.mode, func(ctx context.Context) error {
+				return c.reconcileDelta(ctx, delta)
+			})
+			result.Incremental = true
+			done(result, err)
+			delayCh = c.nextDelayedAlloc()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// reconcileDelta reaps or restores only the targets affected by delta.
+func (c *Reaper) reconcileDelta(ctx context.Context, delta *watchDelta) error {
+	if len(delta.deregisteredNodes) > 0 {
+		if err := c.deactivateTargets(ctx, sortedKeys(delta.deregisteredNodes)); err != nil {
+			return err
+		}
+	}
+
+	if len(delta.registeredNodes) > 0 && c.reactivateHosts {
+		if err := c.reactivateTargets(ctx, delta.registeredNodes, reasonBackInConsul); err != nil {
+			return errwrap.Wrapf("unable to re-activate returning hosts: {{err}}", err)
+		}
+	}
+
+	if len(delta.allocNodeIDs) > 0 {
+		nomadNameToID, err := c.buildNomadNameIDCache(ctx)
+		if err != nil {
+			return errwrap.Wrapf("unable to populate Nomad Node to ID cache: {{err}}", err)
+		}
+
+		for _, host := range sortedKeys(nomadHostsForNodeIDs(nomadNameToID, delta.allocNodeIDs)) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if c.excludeTarget(host) {
+				c.log.Info("skipping excluded nomad client", "target", host, "action", decisionSkip)
+				c.report.addTarget(host, decisionSkip, reasonExcluded)
+				continue
+			}
+
+			if err := c.reconcileNomadAllocs(ctx, host, nomadNameToID[host]); err != nil {
+				c.log.Error("unable to reconcile nomad allocs", "target", host, "error", err)
+				c.recordFailure(failureKindTarget, host, err)
+				continue
+			}
+		}
+	}
+
+	if err := c.reconcileRuleSets(ctx); err != nil {
+		return errwrap.Wrapf("unable to reconcile rule sets: {{err}}", err)
+	}
+
+	return nil
+}
+
+// watchConsulNodes sends the nodes that join or leave the Consul catalog to
+// deltaCh until ctx is cancelled.  ready is closed once the baseline that
+// changes are detected against has been listed.
+func (c *Reaper) watchConsulNodes(ctx context.Context, consulClient *consulapi.Client, ready chan<- struct{}, deltaCh chan<- *watchDelta) {
+	var (
+		index uint64
+		known map[string]struct{}
+	)
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		queryOpts := &consulapi.QueryOptions{
+			AllowStale: true,
+			WaitIndex:  index,
+			WaitTime:   watchWaitTime,
+		}
+		var (
+			nodes []*consulapi.Node
+			meta  *consulapi.QueryMeta
+		)
+		start := time.Now()
+		err := c.blockingCall(ctx, func() (err error) {
+			nodes, meta, err = consulClient.Catalog().Nodes(queryOpts)
+			return err
+		})
+		c.observeAPICall("ConsulCatalogNodesWatch", start, err)
+		if err != nil {
+			c.logger.Error("unable to watch consul catalog nodes", "error", err)
+			watchBackoff(ctx)
+			continue
+		}
+
+		// Start over if the index went backwards, e.g. after a Consul restore.
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		if meta.LastIndex == index {
+			continue
+		}
+		index = meta.LastIndex
+
+		current := make(map[string]struct{}, len(nodes))
+		for _, node := range nodes {
+			current[node.Node] = struct{}{}
+		}
+
+		if known == nil {
+			close(ready)
+		} else {
+			delta := newWatchDelta()
+			for node := range known {
+				if _, found := current[node]; !found {
+					delta.deregisteredNodes[node] = struct{}{}
+				}
+			}
+			for node := range current {
+				if _, found := known[node]; !found {
+					delta.registeredNodes[node] = struct{}{}
+				}
+			}
+
+			if !delta.empty() {
+				c.logger.Debug("consul catalog changed", "deregistered", len(delta.deregisteredNodes), "registered", len(delta.registeredNodes))
+				select {
+				case deltaCh <- delta:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		known = current
+	}
+}
+
+// watchNomadAllocs sends the Nomad nodes whose allocs started or stopped to
+// deltaCh until ctx is cancelled.  ready is closed once the baseline that
+// changes are detected against has been listed.
+func (c *Reaper) watchNomadAllocs(ctx context.Context, nomadClient *nomadapi.Client, ready chan<- struct{}, deltaCh chan<- *watchDelta) {
+	var (
+		index uint64
+		known map[string]string // alloc ID -> node ID of live allocs
+	)
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		queryOpts := &nomadapi.QueryOptions{
+			AllowStale: true,
+			WaitIndex:  index,
+			WaitTime:   watchWaitTime,
+		}
+		var (
+			allocs []*nomadapi.AllocationListStub
+			meta   *nomadapi.QueryMeta
+		)
+		start := time.Now()
+		err := c.blockingCall(ctx, func() (err error) {
+			allocs, meta, err = nomadClient.Allocations().List(queryOpts)
+			return err
+		})
+		c.observeAPICall("NomadAllocationsWatch", start, err)
+		if err != nil {
+			c.logger.Error("unable to watch nomad allocations", "error", err)
+			watchBackoff(ctx)
+			continue
+		}
+
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		if meta.LastIndex == index {
+			continue
+		}
+		index = meta.LastIndex
+
+		current := make(map[string]string, len(allocs))
+		for _, alloc := range allocs {
+			switch alloc.ClientStatus {
+			case "pending", "running":
+				current[alloc.ID] = alloc.NodeID
+			}
+		}
+
+		if known == nil {
+			close(ready)
+		} else {
+			delta := newWatchDelta()
+			for allocID, nodeID := range known {
+				if _, found := current[allocID]; !found {
+					delta.allocNodeIDs[nodeID] = struct{}{}
+				}
+			}
+			for allocID, nodeID := range current {
+				if _, found := known[allocID]; !found {
+					delta.allocNodeIDs[nodeID] = struct{}{}
+				}
+			}
+
+			if !delta.empty() {
+				c.logger.Debug("nomad allocations changed", "nodes", len(delta.allocNodeIDs))
+				select {
+				case deltaCh <- delta:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		known = current
+	}
+}
+
+// blockingCall runs a blocking query bounded by ctx and blockingCallTimeout.
+func (c *Reaper) blockingCall(ctx context.Context, call func() error) error {
+	return callWithTimeout(ctx, blockingCallTimeout(c.requestTimeout), call)
+}
+
+// watchBackoff waits before a failed watch is retried, or until ctx is
+// cancelled.
+func watchBackoff(ctx context.Context) {
+	select {
+	case <-time.After(watchRetryInterval):
+	case <-ctx.Done():
+	}
+}
+
+// nextDelayedAlloc returns a channel that fires when the first alloc kept by a
+// delay policy becomes reapable, or nil if no allocs are delayed.
+func (c *Reaper) nextDelayedAlloc() <-chan time.Time {
+	var next time.Time
+	for _, due := range c.delayedAllocNodes {
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+
+	if next.IsZero() {
+		return nil
+	}
+
+	return time.After(time.Until(next))
+}
+
+// dueDelayedAllocNodes adds the Nomad nodes whose delayed allocs are
+// reapable at now to nodeIDs and forgets them.  Allocs that are still delayed
+// when the nodes are reconciled are remembered again.
+func (c *Reaper) dueDelayedAllocNodes(nodeIDs map[string]struct{}, now time.Time) map[string]struct{} {
+	for nodeID, due := range c.delayedAllocNodes {
+		if due.After(now) {
+			continue
+		}
+		nodeIDs[nodeID] = struct{}{}
+		delete(c.delayedAllocNodes, nodeID)
+	}
+
+	return nodeIDs
+}
+
+// nomadHostsForNodeIDs returns the names of the given Nomad node IDs.
+func nomadHostsForNodeIDs(nomadNameToID map[string]string, nodeIDs map[string]struct{}) map[string]struct{} {
+	hosts := make(map[string]struct{}, len(nodeIDs))
+	for name, id := range nomadNameToID {
+		if _, found := nodeIDs[id]; found {
+			hosts[name] = struct{}{}
+		}
+	}
+
+	return hosts
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
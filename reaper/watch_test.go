@@ -0,0 +1,269 @@
+package reaper
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// delta returns a watchDelta of the given changes.
+func delta(deregistered, registered, allocNodeIDs []string) *watchDelta {
+	d := newWatchDelta()
+	for _, node := range deregistered {
+		d.deregisteredNodes[node] = struct{}{}
+	}
+	for _, node := range registered {
+		d.registeredNodes[node] = struct{}{}
+	}
+	for _, nodeID := range allocNodeIDs {
+		d.allocNodeIDs[nodeID] = struct{}{}
+	}
+	return d
+}
+
+func TestWatchDeltaMerge(t *testing.T) {
+	tests := []struct {
+		name      string
+		pending   *watchDelta
+		other     *watchDelta
+		want      *watchDelta
+		wantEmpty bool
+	}{
+		{
+			name:      "empty",
+			pending:   delta(nil, nil, nil),
+			other:     delta(nil, nil, nil),
+			want:      delta(nil, nil, nil),
+			wantEmpty: true,
+		},
+		{
+			name:    "new changes",
+			pending: delta(nil, nil, nil),
+			other:   delta([]string{"a"}, []string{"b"}, []string{"n1"}),
+			want:    delta([]string{"a"}, []string{"b"}, []string{"n1"}),
+		},
+		{
+			name:      "left and came back",
+			pending:   delta([]string{"a"}, nil, nil),
+			other:     delta(nil, []string{"a"}, nil),
+			want:      delta(nil, nil, nil),
+			wantEmpty: true,
+		},
+		{
+			name:      "came and left",
+			pending:   delta(nil, []string{"a"}, nil),
+			other:     delta([]string{"a"}, nil, nil),
+			want:      delta(nil, nil, nil),
+			wantEmpty: true,
+		},
+		{
+			name:    "left twice",
+			pending: delta([]string{"a"}, nil, nil),
+			other:   delta([]string{"a", "b"}, nil, nil),
+			want:    delta([]string{"a", "b"}, nil, nil),
+		},
+		{
+			name:    "alloc node IDs accumulate",
+			pending: delta(nil, nil, []string{"n1"}),
+			other:   delta(nil, nil, []string{"n1", "n2"}),
+			want:    delta(nil, nil, []string{"n1", "n2"}),
+		},
+		{
+			name:    "alloc changes don't cancel",
+			pending: delta([]string{"a"}, nil, []string{"n1"}),
+			other:   delta(nil, []string{"a"}, []string{"n1"}),
+			want:    delta(nil, nil, []string{"n1"}),
+		},
+	}
+
+	for _, test := range tests {
+		test.pending.merge(test.other)
+		if !reflect.DeepEqual(test.pending, test.want) {
+			t.Errorf("%s: merge = %+v, want %+v", test.name, test.pending, test.want)
+		}
+		if test.pending.empty() != test.wantEmpty {
+			t.Errorf("%s: empty = %v, want %v", test.name, test.pending.empty(), test.wantEmpty)
+		}
+	}
+}
+
+// newScriptedWatchServer answers the blocking queries of a watcher with one
+// response per index, setting the index in indexHeader, and then blocks until
+// the request is cancelled.
+func newScriptedWatchServer(indexHeader string, responses []interface{}) *httptest.Server {
+	var (
+		mu     sync.Mutex
+		served int
+	)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		i := served
+		served++
+		mu.Unlock()
+
+		if i >= len(responses) {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set(indexHeader, strconv.Itoa(i+1))
+		json.NewEncoder(w).Encode(responses[i])
+	}))
+}
+
+// receiveWatch waits for ready to be closed and then for a delta on deltaCh
+// if want is set, and returns the delta received, if any.
+func receiveWatch(ready <-chan struct{}, deltaCh <-chan *watchDelta, want *watchDelta) (bool, *watchDelta) {
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		return false, nil
+	}
+
+	wait := 100 * time.Millisecond
+	if want != nil {
+		wait = 5 * time.Second
+	}
+	select {
+	case got := <-deltaCh:
+		return true, got
+	case <-time.After(wait):
+		return true, nil
+	}
+}
+
+func TestWatchConsulNodes(t *testing.T) {
+	nodes := func(names ...string) []*consulapi.Node {
+		nodes := make([]*consulapi.Node, 0, len(names))
+		for _, name := range names {
+			nodes = append(nodes, &consulapi.Node{Node: name})
+		}
+		return nodes
+	}
+
+	tests := []struct {
+		name      string
+		responses []interface{}
+		want      *watchDelta
+	}{
+		{
+			name:      "baseline only",
+			responses: []interface{}{nodes("web1", "web2")},
+		},
+		{
+			name:      "node left after the baseline",
+			responses: []interface{}{nodes("web1", "web2"), nodes("web1")},
+			want:      delta([]string{"web2"}, nil, nil),
+		},
+		{
+			name:      "node joined after the baseline",
+			responses: []interface{}{nodes("web1"), nodes("web1", "web2")},
+			want:      delta(nil, []string{"web2"}, nil),
+		},
+	}
+
+	for _, test := range tests {
+		srv := newScriptedWatchServer("X-Consul-Index", test.responses)
+		consulClient, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+		if err != nil {
+			t.Fatalf("%s: unable to create consul client: %v", test.name, err)
+		}
+		f := newFakeCirconus(t)
+		c := newTestReaper(t, f, Config{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ready := make(chan struct{})
+		deltaCh := make(chan *watchDelta)
+		go c.watchConsulNodes(ctx, consulClient, ready, deltaCh)
+
+		isReady, got := receiveWatch(ready, deltaCh, test.want)
+		if !isReady {
+			t.Errorf("%s: watcher never took its baseline", test.name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got delta %+v, want %+v", test.name, got, test.want)
+		}
+
+		cancel()
+		srv.CloseClientConnections()
+		srv.Close()
+		f.Close()
+	}
+}
+
+func TestWatchNomadAllocs(t *testing.T) {
+	allocs := func(statuses ...string) []*nomadapi.AllocationListStub {
+		allocs := make([]*nomadapi.AllocationListStub, 0, len(statuses))
+		for i, status := range statuses {
+			allocs = append(allocs, &nomadapi.AllocationListStub{
+				ID:           "alloc" + strconv.Itoa(i+1),
+				NodeID:       "node" + strconv.Itoa(i+1),
+				ClientStatus: status,
+			})
+		}
+		return allocs
+	}
+
+	tests := []struct {
+		name      string
+		responses []interface{}
+		want      *watchDelta
+	}{
+		{
+			name:      "baseline only",
+			responses: []interface{}{allocs("running", "pending")},
+		},
+		{
+			name:      "alloc stopped after the baseline",
+			responses: []interface{}{allocs("running", "running"), allocs("running", "complete")},
+			want:      delta(nil, nil, []string{"node2"}),
+		},
+		{
+			name:      "alloc started after the baseline",
+			responses: []interface{}{allocs("running"), allocs("running", "pending")},
+			want:      delta(nil, nil, []string{"node2"}),
+		},
+		{
+			name:      "pending alloc started running",
+			responses: []interface{}{allocs("pending"), allocs("running")},
+		},
+	}
+
+	for _, test := range tests {
+		srv := newScriptedWatchServer("X-Nomad-Index", test.responses)
+		nomadConfig := nomadapi.DefaultConfig()
+		nomadConfig.Address = srv.URL
+		nomadClient, err := nomadapi.NewClient(nomadConfig)
+		if err != nil {
+			t.Fatalf("%s: unable to create nomad client: %v", test.name, err)
+		}
+		f := newFakeCirconus(t)
+		c := newTestReaper(t, f, Config{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ready := make(chan struct{})
+		deltaCh := make(chan *watchDelta)
+		go c.watchNomadAllocs(ctx, nomadClient, ready, deltaCh)
+
+		isReady, got := receiveWatch(ready, deltaCh, test.want)
+		if !isReady {
+			t.Errorf("%s: watcher never took its baseline", test.name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got delta %+v, want %+v", test.name, got, test.want)
+		}
+
+		cancel()
+		srv.CloseClientConnections()
+		srv.Close()
+		f.Close()
+	}
+}
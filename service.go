@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/sean-/circonus-reaper/reaper"
+)
+
+// serviceState tracks the outcome of every reaping cycle when the reaper runs
+// as a long-lived service.  Counters are cumulative across cycles.
+type serviceState struct {
+	lock sync.Mutex
+
+	mode      string
+	apiErrors func() map[string]uint
+
+	cyclesSucceeded       uint
+	cyclesPartiallyFailed uint
+	cyclesFailed          uint
+
+	lastCycleErr      error
+	lastCycleFailures int
+	lastCycleDuration time.Duration
+	lastSuccess       time.Time
+	suspiciousReason  string
+
+	disabledTargets uint
+	excludedTargets uint
+	disabledMetrics uint
+	enabledMetrics  uint
+
+	consulHosts     uint
+	circonusTargets uint
+	nomadClients    uint
+	liveAllocs      uint
+}
+
+func newServiceState(r *reaper.Reaper, mode string) *serviceState {
+	return &serviceState{mode: mode, apiErrors: r.APIErrors}
+}
+
+// RecordCycle folds the result of the cycle that just completed into the
+// service state.  Incremental cycles don't list the inventories, so the
+// inventory sizes of the last full cycle are kept.
+func (s *serviceState) RecordCycle(result *reaper.Result, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := result.Stats
+	s.lastCycleDuration = result.Report.Run.End.Sub(result.Report.Run.Start)
+	s.lastCycleErr = err
+	s.lastCycleFailures = len(result.Failures)
+	switch {
+	case err != nil:
+		s.cyclesFailed++
+	case len(result.Failures) > 0:
+		s.cyclesPartiallyFailed++
+	default:
+		s.cyclesSucceeded++
+		s.lastSuccess = time.Now()
+	}
+
+	s.disabledTargets += stats.DisabledTargets
+	s.excludedTargets += stats.ExcludedTargets
+	s.disabledMetrics += stats.DisabledMetrics
+	s.enabledMetrics += stats.EnabledMetrics
+
+	if result.Incremental {
+		return
+	}
+
+	s.suspiciousReason = ""
+	if s.mode == reaper.ModeHosts || s.mode == reaper.ModeConsulNomad {
+		switch {
+		case stats.Hosts == 0:
+			s.suspiciousReason = "consul returned no hosts"
+		case s.consulHosts > 0 && stats.Hosts < s.consulHosts/2:
+			s.suspiciousReason = fmt.Sprintf("consul inventory shrank from %d to %d hosts", s.consulHosts, stats.Hosts)
+		}
+	}
+
+	s.consulHosts = stats.Hosts
+	s.circonusTargets = stats.CirconusTargets
+	s.nomadClients = stats.NomadClients
+	s.liveAllocs = stats.LiveAllocs
+}
+
+// Healthy reports whether the last cycle succeeded and its inventory looked
+// sane.  The returned string explains why the service is unhealthy.
+func (s *serviceState) Healthy() (bool, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case s.cyclesSucceeded+s.cyclesPartiallyFailed+s.cyclesFailed == 0:
+		return false, "no cycle has completed yet"
+	case s.lastCycleErr != nil:
+		return false, fmt.Sprintf("last cycle failed: %v", s.lastCycleErr)
+	case s.suspiciousReason != "":
+		return false, fmt.Sprintf("suspicious inventory: %s", s.suspiciousReason)
+	case s.lastCycleFailures > 0:
+		// Objects that failed are retried by the next cycle.
+		return true, fmt.Sprintf("last cycle partially failed: %d failures", s.lastCycleFailures)
+	}
+
+	return true, "ok"
+}
+
+func (s *serviceState) handleHealth(w http.ResponseWriter, r *http.Request) {
+	healthy, reason := s.Healthy()
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, reason)
+}
+
+func (s *serviceState) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WritePrometheus(w)
+}
+
+// WritePrometheus writes the service state in the Prometheus text exposition
+// format.
+func (s *serviceState) WritePrometheus(w io.Writer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writeMetric := func(name, help, metricType string, samples ...string) {
+		fmt.Fprintf(w, "# HELP circonus_reaper_%s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE circonus_reaper_%s %s\n", name, metricType)
+		for _, sample := range samples {
+			fmt.Fprintf(w, "circonus_reaper_%s%s\n", name, sample)
+		}
+	}
+
+	writeMetric("cycles_total", "Number of completed reaping cycles.", "counter",
+		fmt.Sprintf(`{result="success"} %d`, s.cyclesSucceeded),
+		fmt.Sprintf(`{result="partial_failure"} %d`, s.cyclesPartiallyFailed),
+		fmt.Sprintf(`{result="failure"} %d`, s.cyclesFailed))
+
+	var lastSuccess int64
+	if !s.lastSuccess.IsZero() {
+		lastSuccess = s.lastSuccess.Unix()
+	}
+	writeMetric("last_successful_cycle_timestamp_seconds", "Unix time of the last successful reaping cycle.", "gauge",
+		fmt.Sprintf(" %d", lastSuccess))
+	writeMetric("last_cycle_duration_seconds", "Duration of the last reaping cycle.", "gauge",
+		fmt.Sprintf(" %f", s.lastCycleDuration.Seconds()))
+
+	writeMetric("targets_disabled_total", "Number of targets whose check bundles were deactivated.", "counter",
+		fmt.Sprintf(" %d", s.disabledTargets))
+	writeMetric("targets_excluded_total", "Number of targets skipped because they were excluded.", "counter",
+		fmt.Sprintf(" %d", s.excludedTargets))
+	writeMetric("metrics_disabled_total", "Number of metrics toggled to available.", "counter",
+		fmt.Sprintf(" %d", s.disabledMetrics))
+	writeMetric("metrics_enabled_total", "Number of metrics toggled to active.", "counter",
+		fmt.Sprintf(" %d", s.enabledMetrics))
+
+	errorCounts := s.apiErrors()
+	operations := make([]string, 0, len(errorCounts))
+	for op := range errorCounts {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+	errorSamples := make([]string, 0, len(operations))
+	for _, op := range operations {
+		errorSamples = append(errorSamples, fmt.Sprintf(`{operation=%q} %d`, op, errorCounts[op]))
+	}
+	writeMetric("api_errors_total", "Number of failed API calls by operation.", "counter", errorSamples...)
+
+	writeMetric("inventory_size", "Number of entries seen in each inventory during the last cycle.", "gauge",
+		fmt.Sprintf(`{source="consul"} %d`, s.consulHosts),
+		fmt.Sprintf(`{source="circonus"} %d`, s.circonusTargets),
+		fmt.Sprintf(`{source="nomad"} %d`, s.nomadClients),
+		fmt.Sprintf(`{source="nomad_allocs"} %d`, s.liveAllocs))
+}
+
+// runService runs a reaping cycle every interval (or, with -watch, whenever
+// Consul or Nomad change) until ctx is cancelled.  It backs the daemon
+// command.  If an HTTP address was
+// configured, /metrics and /health are served for the lifetime of the
+// service.
+func runService(ctx context.Context, r *reaper.Reaper, cli *cliConfig) error {
+	state := newServiceState(r, cli.mode)
+
+	if cli.httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", state.handleHealth)
+		mux.HandleFunc("/metrics", state.handleMetrics)
+
+		listener, err := net.Listen("tcp", cli.httpAddr)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to listen on %q: {{err}}", cli.httpAddr), err)
+		}
+
+		server := &http.Server{Handler: mux}
+		go func() {
+			logger.Info("listening for HTTP requests", "addr", listener.Addr().String())
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logger.Error("HTTP listener failed", "addr", listener.Addr().String(), "error", err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	if cli.watch {
+		err := r.Watch(ctx, func(result *reaper.Result, err error) {
+			state.RecordCycle(result, finishRun(cli, result, err))
+		})
+		if err == nil {
+			logger.Info("shutting down")
+		}
+		return err
+	}
+
+	ticker := time.NewTicker(cli.interval)
+	defer ticker.Stop()
+
+	for {
+		state.RecordCycle(runOnce(ctx, r, cli))
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Info("shutting down")
+			return nil
+		}
+	}
+}